@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	DefaultArchiveRetention = 30 * 24 * time.Hour
+
+	// how often superseded events past the retention are deleted
+	archivePruneInterval = time.Hour
+	// events replayed per query by the rebuild
+	rebuildBatchSize = 1000
+)
+
+// Event is a signed event exactly as a relay sent it, kept so the graph can be
+// audited and rebuilt. Every event is stored once, Relay is where it came from first.
+type Event struct {
+	ID             string    `gorm:"primaryKey;size:65"`
+	Pubkey         string    `gorm:"size:65;index:idx_events_pubkey_kind"`
+	Kind           int       `gorm:"index:idx_events_pubkey_kind"`
+	EventCreatedAt time.Time `gorm:"default:1970-01-01 00:00:00"`
+	Tags           eventTags `gorm:"serializer:json"`
+	Content        eventText
+	Sig            string    `gorm:"size:129"`
+	Relay          string    `gorm:"size:512"`
+	ReceivedAt     time.Time `gorm:"default:1970-01-01 00:00:00"`
+	// Latest is false for older versions of a replaceable event, they are
+	// deleted once they were superseded longer than the retention
+	Latest       bool      `gorm:"index"`
+	SupersededAt time.Time `gorm:"default:1970-01-01 00:00:00"`
+}
+
+// eventText and eventTags are columns that can hold megabytes, follow lists
+// with thousands of p tags are common. Each dialect gets its own type as text
+// stops at 64KB on mysql and varchar at 10MB on postgres.
+type eventText string
+type eventTags nostr.Tags
+
+func (eventText) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return eventColumnType(db)
+}
+
+func (eventTags) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	return eventColumnType(db)
+}
+
+func eventColumnType(db *gorm.DB) string {
+	if db.Dialector.Name() == "mysql" {
+		return "mediumtext"
+	}
+	return "text"
+}
+
+// isReplaceable reports whether only the newest event of the kind counts per pubkey
+func isReplaceable(kind int) bool {
+	return kind == 0 || kind == 3 || (kind >= 10000 && kind < 20000)
+}
+
+// newerEvent is the NIP-01 rule for replaceable events: the later created_at
+// wins, on a tie the lowest id
+func newerEvent(ev *nostr.Event, than Event) bool {
+	created := ev.CreatedAt.Time()
+	if !created.Equal(than.EventCreatedAt) {
+		return created.After(than.EventCreatedAt)
+	}
+	return ev.ID < than.ID
+}
+
+// archiveEvent stores a checked event unless it is archived already, a newer
+// replaceable event supersedes the latest one
+func archiveEvent(db *gorm.DB, ev *nostr.Event, relay string) {
+	now := time.Now()
+	archived := Event{
+		ID:             ev.ID,
+		Pubkey:         ev.PubKey,
+		Kind:           ev.Kind,
+		EventCreatedAt: ev.CreatedAt.Time(),
+		Tags:           eventTags(ev.Tags),
+		Content:        eventText(ev.Content),
+		Sig:            ev.Sig,
+		Relay:          relay,
+		ReceivedAt:     now,
+		Latest:         true,
+		SupersededAt:   time.Unix(0, 0),
+	}
+	supersedes := false
+	if isReplaceable(ev.Kind) {
+		var latest Event
+		if db.Where("pubkey = ? and kind = ? and latest = ?", ev.PubKey, ev.Kind, true).First(&latest).Error == nil && latest.ID != ev.ID {
+			if newerEvent(ev, latest) {
+				supersedes = true
+			} else {
+				archived.Latest = false
+				archived.SupersededAt = now
+			}
+		}
+	}
+
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&archived)
+	if result.Error != nil {
+		TheLog.Printf("Error archiving event %s: %s", ev.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		// another relay sent it first
+		return
+	}
+	if supersedes {
+		db.Model(&Event{}).Where("pubkey = ? and kind = ? and latest = ? and id <> ?", ev.PubKey, ev.Kind, true, ev.ID).
+			Updates(map[string]interface{}{"latest": false, "superseded_at": now})
+	}
+}
+
+// pruneArchive deletes superseded events older than retention, a retention of 0 keeps them all
+func pruneArchive(db *gorm.DB, retention time.Duration) int64 {
+	if retention <= 0 {
+		return 0
+	}
+	result := db.Where("latest = ? and superseded_at < ?", false, time.Now().Add(-retention)).Delete(&Event{})
+	if result.Error != nil {
+		TheLog.Printf("Error pruning event archive: %s", result.Error)
+	}
+	return result.RowsAffected
+}
+
+// startArchivePruning periodically applies the archive retention
+func startArchivePruning(db *gorm.DB) {
+	go func() {
+		for {
+			if pruned := pruneArchive(db, time.Duration(TheConfig.ArchiveRetention)); pruned > 0 {
+				TheLog.Printf("pruned %d superseded events from the archive", pruned)
+			}
+			time.Sleep(archivePruneInterval)
+		}
+	}()
+}
+
+// rebuildFromArchive throws away the profiles, follow, mute and relay lists and
+// replays them from the latest archived events. Members, scores and every
+// other table are kept. The server should not be scraping meanwhile.
+func rebuildFromArchive(db *gorm.DB) (int, error) {
+	for _, table := range []string{"metadata_follows", "metadata_mutes"} {
+		if err := db.Exec("delete from " + table).Error; err != nil {
+			return 0, err
+		}
+	}
+	if err := db.Where("1 = 1").Delete(&RelayList{}).Error; err != nil {
+		return 0, err
+	}
+	// the rows stay, scores and members point at them
+	err := db.Model(&Metadata{}).Where("1 = 1").Updates(map[string]interface{}{
+		"pubkey_npub":         "",
+		"name":                "",
+		"about":               "",
+		"nip05":               "",
+		"lud06":               "",
+		"lud16":               "",
+		"website":             "",
+		"display_name":        "",
+		"picture":             "",
+		"raw_json_content":    "",
+		"total_follows":       0,
+		"total_mutes":         0,
+		"contacts_updated_at": time.Unix(0, 0),
+		"metadata_updated_at": time.Unix(0, 0),
+		"mutes_updated_at":    time.Unix(0, 0),
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	// profiles first, applying one creates the row with empty list timestamps
+	replayed := 0
+	for _, kind := range []int{0, 3, 10000, KindRelayList} {
+		var events []Event
+		result := db.Where("kind = ? and latest = ?", kind, true).FindInBatches(&events, rebuildBatchSize, func(tx *gorm.DB, batch int) error {
+			for _, archived := range events {
+				applyEvent(archived.nostrEvent())
+				replayed++
+			}
+			fmt.Printf("replayed %d events\n", replayed)
+			return nil
+		})
+		if result.Error != nil {
+			return replayed, result.Error
+		}
+	}
+	return replayed, nil
+}
+
+func (e Event) nostrEvent() *nostr.Event {
+	return &nostr.Event{
+		ID:        e.ID,
+		PubKey:    e.Pubkey,
+		CreatedAt: nostr.Timestamp(e.EventCreatedAt.Unix()),
+		Kind:      e.Kind,
+		Tags:      nostr.Tags(e.Tags),
+		Content:   string(e.Content),
+		Sig:       e.Sig,
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// NIP-98 HTTP Auth
+const KindHTTPAuth = 27235
+
+// how far the auth event created_at may be from our clock
+const authTimeWindow = 60 * time.Second
+
+// AuthPolicy decides who may call a member scoped endpoint
+type AuthPolicy int
+
+const (
+	// AuthOpen lets anyone in
+	AuthOpen AuthPolicy = iota
+	// AuthMember needs a NIP-98 header signed by the member or an admin
+	AuthMember
+	// AuthAdmin needs a NIP-98 header signed by an admin
+	AuthAdmin
+)
+
+// ReadPolicy is applied to the read only member endpoints, read_auth: member turns it on
+var ReadPolicy = AuthOpen
+
+func parseReadPolicy(policy string) AuthPolicy {
+	switch policy {
+	case "member":
+		return AuthMember
+	case "admin":
+		return AuthAdmin
+	default:
+		return AuthOpen
+	}
+}
+
+// adminPubkeys are the configured admins as hex, they can be given as hex or npub
+func adminPubkeys() map[string]bool {
+	admins := make(map[string]bool)
+	for _, k := range TheConfig.AdminPubkeys {
+		if hexKey := toHexPubkey(k); hexKey != "" {
+			admins[hexKey] = true
+		}
+	}
+	return admins
+}
+
+// toHexPubkey accepts a hex pubkey or an npub, returns "" when it is neither
+func toHexPubkey(key string) string {
+	if strings.HasPrefix(key, "npub1") {
+		_, v, err := nip19.Decode(key)
+		if err != nil {
+			return ""
+		}
+		if s, ok := v.(string); ok {
+			return s
+		}
+		return ""
+	}
+	if len(key) == 64 && isHex(key) {
+		return strings.ToLower(key)
+	}
+	return ""
+}
+
+// checkEvent verifies that the id is the hash of the event and the signature matches the pubkey
+func checkEvent(ev *nostr.Event) error {
+	if ev.GetID() != ev.ID {
+		return errors.New("event id does not match its content")
+	}
+	ok, err := ev.CheckSignature()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("invalid event signature")
+	}
+	return nil
+}
+
+// requestURL rebuilds the absolute url the client signed. Set PUBLIC_URL when
+// running behind a proxy that rewrites the host.
+func requestURL(r *http.Request) string {
+	base := TheConfig.PublicURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		base = scheme + "://" + r.Host
+	}
+	return strings.TrimSuffix(base, "/") + r.URL.RequestURI()
+}
+
+// verifyNip98 checks the Authorization header of a request and returns the signer's pubkey
+func verifyNip98(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Nostr ") {
+		return "", errors.New("missing Nostr authorization header")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(header, "Nostr ")))
+	if err != nil {
+		return "", errors.New("authorization header is not base64")
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return "", errors.New("authorization header is not a nostr event")
+	}
+
+	if ev.Kind != KindHTTPAuth {
+		return "", fmt.Errorf("auth event must be kind %d", KindHTTPAuth)
+	}
+	created := ev.CreatedAt.Time()
+	if time.Since(created) > authTimeWindow || time.Until(created) > authTimeWindow {
+		return "", errors.New("auth event created_at is outside the allowed window")
+	}
+	if u := ev.Tags.GetFirst([]string{"u", ""}); u == nil || (*u).Value() != requestURL(r) {
+		return "", errors.New("auth event u tag does not match the request url")
+	}
+	if m := ev.Tags.GetFirst([]string{"method", ""}); m == nil || !strings.EqualFold((*m).Value(), r.Method) {
+		return "", errors.New("auth event method tag does not match the request method")
+	}
+	if payload := ev.Tags.GetFirst([]string{"payload", ""}); payload != nil && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		if hex.EncodeToString(hash[:]) != (*payload).Value() {
+			return "", errors.New("auth event payload tag does not match the request body")
+		}
+	}
+	if err := checkEvent(&ev); err != nil {
+		return "", err
+	}
+	return ev.PubKey, nil
+}
+
+// authorize checks a request against a policy for the member in the {key} route var
+func authorize(policy AuthPolicy, r *http.Request) error {
+	if policy == AuthOpen {
+		return nil
+	}
+	signer, err := verifyNip98(r)
+	if err != nil {
+		return err
+	}
+	if adminPubkeys()[signer] {
+		return nil
+	}
+	if policy == AuthMember && signer == toHexPubkey(mux.Vars(r)["key"]) {
+		return nil
+	}
+	return errors.New("signer is not allowed to access this member")
+}
+
+// withAuth wraps a handler so it only runs for requests allowed by policy
+func withAuth(policy AuthPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorize(policy, r); err != nil {
+			w.Header().Set("WWW-Authenticate", "Nostr")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		next(w, r)
+	}
+}
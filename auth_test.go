@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestAuthorize(t *testing.T) {
+	memberKey := nostr.GeneratePrivateKey()
+	member, _ := nostr.GetPublicKey(memberKey)
+	memberNpub, _ := nip19.EncodePublicKey(member)
+	otherKey := nostr.GeneratePrivateKey()
+	other, _ := nostr.GetPublicKey(otherKey)
+	adminKey := nostr.GeneratePrivateKey()
+	admin, _ := nostr.GetPublicKey(adminKey)
+
+	config := TheConfig
+	defer func() { TheConfig = config }()
+	TheConfig.PublicURL = "https://gv.example.com"
+	TheConfig.AdminPubkeys = []string{admin}
+
+	body := `{"MaxHops": 3}`
+	bodyHash := sha256.Sum256([]byte(body))
+
+	// err is part of the error, empty when the request is allowed
+	tests := []struct {
+		name   string
+		policy AuthPolicy
+		signer string
+		key    string
+		// change edits the event before it is signed, tamper after
+		change func(ev *nostr.Event)
+		tamper func(ev *nostr.Event)
+		err    string
+	}{
+		{name: "member", policy: AuthMember, signer: memberKey, key: member},
+		{name: "member npub route", policy: AuthMember, signer: memberKey, key: memberNpub},
+		{name: "admin on a member", policy: AuthMember, signer: adminKey, key: member},
+		{name: "admin only", policy: AuthAdmin, signer: adminKey, key: member},
+		{name: "open", policy: AuthOpen, key: member},
+		{name: "payload", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.Tags = append(ev.Tags, nostr.Tag{"payload", hex.EncodeToString(bodyHash[:])})
+		}},
+		{name: "no header", policy: AuthMember, key: member, err: "missing"},
+		{name: "another member", policy: AuthMember, signer: otherKey, key: member, err: "not allowed"},
+		{name: "member on admin only", policy: AuthAdmin, signer: memberKey, key: member, err: "not allowed"},
+		{name: "wrong kind", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.Kind = nostr.KindTextNote
+		}, err: "kind"},
+		{name: "stale", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.CreatedAt = nostr.Timestamp(time.Now().Add(-2 * authTimeWindow).Unix())
+		}, err: "window"},
+		{name: "future", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.CreatedAt = nostr.Timestamp(time.Now().Add(2 * authTimeWindow).Unix())
+		}, err: "window"},
+		{name: "other url", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.Tags[0] = nostr.Tag{"u", "https://gv.example.com/api/members/" + other + "/calculate"}
+		}, err: "u tag"},
+		{name: "other method", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.Tags[1] = nostr.Tag{"method", "GET"}
+		}, err: "method tag"},
+		{name: "bad payload", policy: AuthMember, signer: memberKey, key: member, change: func(ev *nostr.Event) {
+			ev.Tags = append(ev.Tags, nostr.Tag{"payload", strings.Repeat("0", 64)})
+		}, err: "payload tag"},
+		{name: "tampered sig", policy: AuthMember, signer: memberKey, key: member, tamper: func(ev *nostr.Event) {
+			ev.Sig = strings.Repeat("0", 128)
+		}, err: "signature"},
+		{name: "tampered content", policy: AuthMember, signer: memberKey, key: member, tamper: func(ev *nostr.Event) {
+			ev.Content = "changed"
+		}, err: "id does not match"},
+		{name: "signed by someone else", policy: AuthMember, signer: otherKey, key: member, tamper: func(ev *nostr.Event) {
+			ev.PubKey = member
+		}, err: "id does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/api/members/" + tt.key + "/calculate"
+			r := httptest.NewRequest("POST", path, strings.NewReader(body))
+			r = mux.SetURLVars(r, map[string]string{"key": tt.key})
+			if tt.signer != "" {
+				ev := nostr.Event{
+					Kind:      KindHTTPAuth,
+					CreatedAt: nostr.Now(),
+					Tags: nostr.Tags{
+						{"u", "https://gv.example.com" + path},
+						{"method", "POST"},
+					},
+				}
+				if tt.change != nil {
+					tt.change(&ev)
+				}
+				if err := ev.Sign(tt.signer); err != nil {
+					t.Fatal(err)
+				}
+				if tt.tamper != nil {
+					tt.tamper(&ev)
+				}
+				raw, _ := json.Marshal(ev)
+				r.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString(raw))
+			}
+
+			err := authorize(tt.policy, r)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("not allowed: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigFile = "gvengine.yaml"
+
+// TheConfig is loaded once at startup, the defaults until then
+var TheConfig = DefaultConfig()
+
+// Config holds the server settings. They are read from a yaml file (CONFIG_FILE,
+// or gvengine.yaml when it exists) and every setting can be overridden by the
+// environment variable next to it.
+type Config struct {
+	ListenAddr   string   `yaml:"listen_addr" json:"listen_addr"`     // LISTEN_ADDR
+	CORSOrigins  []string `yaml:"cors_origins" json:"cors_origins"`   // CORS_ORIGINS
+	LogFile      string   `yaml:"log_file" json:"log_file"`           // LOG_FILE
+	ReadTimeout  Duration `yaml:"read_timeout" json:"read_timeout"`   // READ_TIMEOUT
+	WriteTimeout Duration `yaml:"write_timeout" json:"write_timeout"` // WRITE_TIMEOUT
+	IdleTimeout  Duration `yaml:"idle_timeout" json:"idle_timeout"`   // IDLE_TIMEOUT
+	PublicURL    string   `yaml:"public_url" json:"public_url"`       // PUBLIC_URL
+
+	DB       string `yaml:"db" json:"db"`               // DB
+	DBDriver string `yaml:"db_driver" json:"db_driver"` // DB_DRIVER
+
+	Relays            []string `yaml:"relays" json:"relays"`                           // RELAYS
+	NIP85Relays       []string `yaml:"nip85_relays" json:"nip85_relays"`               // NIP85_RELAYS
+	OutboxMinCoverage int      `yaml:"outbox_min_coverage" json:"outbox_min_coverage"` // OUTBOX_MIN_COVERAGE
+	OutboxMaxRelays   int      `yaml:"outbox_max_relays" json:"outbox_max_relays"`     // OUTBOX_MAX_RELAYS
+	// most outbox relay connections the pool keeps open across all scrapes
+	OutboxMaxConnections int `yaml:"outbox_max_connections" json:"outbox_max_connections"` // OUTBOX_MAX_CONNECTIONS
+	// outbox relays no scrape asked anything from for this long are closed, 0 keeps them
+	OutboxIdleTimeout Duration `yaml:"outbox_idle_timeout" json:"outbox_idle_timeout"` // OUTBOX_IDLE_TIMEOUT
+
+	ReadAuth     string   `yaml:"read_auth" json:"read_auth"`         // READ_AUTH
+	AdminPubkeys []string `yaml:"admin_pubkeys" json:"admin_pubkeys"` // ADMIN_PUBKEYS
+	JobWorkers   int      `yaml:"job_workers" json:"job_workers"`     // JOB_WORKERS
+
+	// how often nip05 identifiers are verified again, 0 turns verification off
+	Nip05Interval Duration `yaml:"nip05_interval" json:"nip05_interval"` // NIP05_INTERVAL
+	// how long superseded versions of replaceable events stay in the archive, 0 keeps them
+	ArchiveRetention Duration `yaml:"archive_retention" json:"archive_retention"` // ARCHIVE_RETENTION
+
+	// File is where the config was read from, empty for defaults and env only
+	File string `yaml:"-" json:"file"`
+}
+
+// Duration is a time.Duration written like "15s" in the config file, env and admin view
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:   "0.0.0.0:8080",
+		CORSOrigins:  []string{"*"},
+		LogFile:      "gv.log",
+		ReadTimeout:  Duration(15 * time.Second),
+		WriteTimeout: Duration(15 * time.Second),
+		IdleTimeout:  Duration(60 * time.Second),
+		Relays: []string{
+			"wss://relay.damus.io",
+			"wss://profiles.nostr1.com",
+			"wss://nostr21.com",
+			"wss://relay.primal.net",
+			//"wss://purplepag.es",
+			"wss://nos.lol",
+			"wss://wot.utxo.one",
+		},
+		OutboxMinCoverage:    DefaultOutboxMinCoverage,
+		OutboxMaxRelays:      DefaultOutboxMaxRelays,
+		OutboxMaxConnections: DefaultOutboxMaxConnections,
+		OutboxIdleTimeout:    Duration(DefaultOutboxIdleTimeout),
+		JobWorkers:           2,
+		ArchiveRetention:     Duration(DefaultArchiveRetention),
+		Nip05Interval:        Duration(DefaultNip05Interval),
+	}
+}
+
+// LoadConfig reads the config file, applies the environment and validates the result
+func LoadConfig() (Config, error) {
+	config := DefaultConfig()
+
+	path, found := os.LookupEnv("CONFIG_FILE")
+	if !found {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return config, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// a typo in a key should fail, not silently keep the default
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+			return config, fmt.Errorf("%s: %w", path, err)
+		}
+		config.File = path
+	}
+
+	if err := config.applyEnv(); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+func (c *Config) applyEnv() error {
+	overrides := []struct {
+		name  string
+		field interface{}
+	}{
+		{"LISTEN_ADDR", &c.ListenAddr},
+		{"CORS_ORIGINS", &c.CORSOrigins},
+		{"LOG_FILE", &c.LogFile},
+		{"READ_TIMEOUT", &c.ReadTimeout},
+		{"WRITE_TIMEOUT", &c.WriteTimeout},
+		{"IDLE_TIMEOUT", &c.IdleTimeout},
+		{"PUBLIC_URL", &c.PublicURL},
+		{"DB", &c.DB},
+		{"DB_DRIVER", &c.DBDriver},
+		{"RELAYS", &c.Relays},
+		{"NIP85_RELAYS", &c.NIP85Relays},
+		{"OUTBOX_MIN_COVERAGE", &c.OutboxMinCoverage},
+		{"OUTBOX_MAX_RELAYS", &c.OutboxMaxRelays},
+		{"OUTBOX_MAX_CONNECTIONS", &c.OutboxMaxConnections},
+		{"OUTBOX_IDLE_TIMEOUT", &c.OutboxIdleTimeout},
+		{"READ_AUTH", &c.ReadAuth},
+		{"ADMIN_PUBKEYS", &c.AdminPubkeys},
+		{"JOB_WORKERS", &c.JobWorkers},
+		{"ARCHIVE_RETENTION", &c.ArchiveRetention},
+		{"NIP05_INTERVAL", &c.Nip05Interval},
+	}
+	for _, o := range overrides {
+		value, found := os.LookupEnv(o.name)
+		if !found {
+			continue
+		}
+		switch field := o.field.(type) {
+		case *string:
+			*field = value
+		case *[]string:
+			*field = splitList(value)
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s must be a number: %s", o.name, value)
+			}
+			*field = n
+		case *Duration:
+			if err := field.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("%s must be a duration like 15s: %s", o.name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated env value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (c Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("listen_addr: %w", err)
+	}
+	if len(c.CORSOrigins) == 0 {
+		return errors.New("cors_origins can't be empty, use \"*\" to allow every origin")
+	}
+	if c.LogFile == "" {
+		return errors.New("log_file can't be empty")
+	}
+	if c.ReadTimeout <= 0 || c.WriteTimeout <= 0 || c.IdleTimeout <= 0 {
+		return errors.New("read_timeout, write_timeout and idle_timeout must be positive")
+	}
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("public_url must be an absolute url: %s", c.PublicURL)
+		}
+	}
+	if c.DB == "" {
+		return errors.New("db can't be empty, set it in the config file or DB")
+	}
+	switch c.DBDriver {
+	case "", "mysql", "postgres", "sqlite":
+	default:
+		return fmt.Errorf("db_driver must be mysql, postgres or sqlite: %s", c.DBDriver)
+	}
+	if len(c.Relays) == 0 {
+		return errors.New("relays can't be empty")
+	}
+	for _, relays := range [][]string{c.Relays, c.NIP85Relays} {
+		for _, r := range relays {
+			if normalizeRelayURL(r) == "" {
+				return fmt.Errorf("not a websocket relay url: %s", r)
+			}
+		}
+	}
+	if c.OutboxMinCoverage < 1 {
+		return errors.New("outbox_min_coverage must be at least 1")
+	}
+	if c.OutboxMaxRelays < 0 {
+		return errors.New("outbox_max_relays can't be negative")
+	}
+	if c.OutboxMaxConnections < c.OutboxMaxRelays {
+		return errors.New("outbox_max_connections can't be less than outbox_max_relays")
+	}
+	if c.OutboxIdleTimeout < 0 {
+		return errors.New("outbox_idle_timeout can't be negative")
+	}
+	switch c.ReadAuth {
+	case "", "open", "member", "admin":
+	default:
+		return fmt.Errorf("read_auth must be open, member or admin: %s", c.ReadAuth)
+	}
+	for _, k := range c.AdminPubkeys {
+		if toHexPubkey(k) == "" {
+			return fmt.Errorf("admin_pubkeys: not a hex pubkey or npub: %s", k)
+		}
+	}
+	if c.JobWorkers < 1 {
+		return errors.New("job_workers must be at least 1")
+	}
+	if c.Nip05Interval < 0 {
+		return errors.New("nip05_interval can't be negative")
+	}
+	if c.ArchiveRetention < 0 {
+		return errors.New("archive_retention can't be negative")
+	}
+	return nil
+}
+
+var (
+	dsnURLPassword  = regexp.MustCompile(`^([a-z]+://[^:@/]*):[^@]*@`)
+	dsnPassword     = regexp.MustCompile(`password=\S*`)
+	dsnUserPassword = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+)
+
+// Sanitized is the config with the database password masked, for the admin endpoint
+func (c Config) Sanitized() Config {
+	dsn := c.DB
+	switch {
+	case strings.Contains(dsn, "://"):
+		dsn = dsnURLPassword.ReplaceAllString(dsn, "$1:*****@")
+	case dsnPassword.MatchString(dsn):
+		dsn = dsnPassword.ReplaceAllString(dsn, "password=*****")
+	case dsnUserPassword.MatchString(dsn):
+		dsn = dsnUserPassword.ReplaceAllString(dsn, "$1:*****@")
+	}
+	c.DB = dsn
+	return c
+}
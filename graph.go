@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"gorm.io/gorm"
+)
+
+// how many pubkeys go into one "where ... in ?" query when loading the graph
+const graphChunkSize = 1000
+
+// Graph is the follow/mute neighborhood of a member loaded into memory once per
+// calculation. Pubkeys are interned to int ids so adjacency lists stay compact.
+// Ids are assigned hop by hop in pubkey order and adjacency lists are sorted, so
+// the same follows and mutes always give the same graph whatever order the
+// database returns them in.
+type Graph struct {
+	Pubkey  string
+	pubkeys []string
+	index   map[string]int
+	// depth[id] is how many follows away from the member id is
+	depth []int
+
+	// Follows are the member's direct follows (hop1)
+	Follows []int
+	// Hops are everyone within the max hops of the member, the pubkeys that get scored
+	Hops []int
+	// Truncated is set when the walk stopped early because the graph got too big
+	Truncated bool
+
+	// followers[id] and muters[id] only contain raters that are inside the graph,
+	// raters outside of it never have an influence score so they can't contribute.
+	followers [][]int
+	muters    [][]int
+	// rated[id] is the reverse of both, everyone in the graph id follows or mutes
+	rated [][]int
+	// verified[id] is set for a verified nip05, only loaded when scoring uses it
+	verified []bool
+}
+
+type graphEdge struct {
+	Rater string
+	Ratee string
+}
+
+func newGraph(pubkey string) *Graph {
+	g := &Graph{Pubkey: pubkey, index: make(map[string]int)}
+	g.add(pubkey, 0)
+	return g
+}
+
+// add interns a pubkey and returns its id
+func (g *Graph) add(pubkey string, depth int) int {
+	if id, ok := g.index[pubkey]; ok {
+		return id
+	}
+	id := len(g.pubkeys)
+	g.index[pubkey] = id
+	g.pubkeys = append(g.pubkeys, pubkey)
+	g.depth = append(g.depth, depth)
+	g.followers = append(g.followers, nil)
+	g.muters = append(g.muters, nil)
+	g.rated = append(g.rated, nil)
+	return id
+}
+
+// ID returns the id of a pubkey and whether it is part of the graph
+func (g *Graph) ID(pubkey string) (int, bool) {
+	id, ok := g.index[pubkey]
+	return id, ok
+}
+
+// PubkeyOf returns the pubkey for an id
+func (g *Graph) PubkeyOf(id int) string {
+	return g.pubkeys[id]
+}
+
+// Len is the number of pubkeys in the graph
+func (g *Graph) Len() int {
+	return len(g.pubkeys)
+}
+
+// Followers returns the ids of everyone in the graph following id
+func (g *Graph) Followers(id int) []int {
+	return g.followers[id]
+}
+
+// Muters returns the ids of everyone in the graph muting id
+func (g *Graph) Muters(id int) []int {
+	return g.muters[id]
+}
+
+// Depth returns how many follows away from the member id is
+func (g *Graph) Depth(id int) int {
+	return g.depth[id]
+}
+
+// Rated returns the ids of everyone in the graph that id follows or mutes
+func (g *Graph) Rated(id int) []int {
+	return g.rated[id]
+}
+
+// LoadGraph reads the neighborhood of pubkey, everyone up to maxHops follows
+// away, from the join tables with a handful of chunked queries instead of one
+// query per pubkey. The graph stops growing at maxSize pubkeys.
+func LoadGraph(db *gorm.DB, pubkey string, maxHops int, maxSize int) *Graph {
+	g := newGraph(pubkey)
+	g.walkHops(db, maxHops, maxSize)
+
+	// incoming edges for every pubkey in the graph
+	all := make([]string, len(g.pubkeys))
+	copy(all, g.pubkeys)
+	forEachEdge(db, "metadata_follows", "follow_pubkey_hex", "follow_pubkey_hex", all, func(e graphEdge) {
+		rater, ok := g.index[e.Rater]
+		if !ok {
+			return
+		}
+		ratee := g.index[e.Ratee]
+		g.followers[ratee] = append(g.followers[ratee], rater)
+		g.rated[rater] = append(g.rated[rater], ratee)
+	})
+	forEachEdge(db, "metadata_mutes", "mute_pubkey_hex", "mute_pubkey_hex", all, func(e graphEdge) {
+		rater, ok := g.index[e.Rater]
+		if !ok {
+			return
+		}
+		ratee := g.index[e.Ratee]
+		g.muters[ratee] = append(g.muters[ratee], rater)
+		g.rated[rater] = append(g.rated[rater], ratee)
+	})
+	for id := range g.pubkeys {
+		sort.Ints(g.followers[id])
+		sort.Ints(g.muters[id])
+		sort.Ints(g.rated[id])
+	}
+
+	TheLog.Printf("loaded graph for %s: %d follows, %d hops, %d pubkeys, truncated: %v", pubkey, len(g.Follows), len(g.Hops), g.Len(), g.Truncated)
+	return g
+}
+
+// HopLevels returns the pubkeys at each distance from the member, levels[0]
+// are the follows, levels[1] the follows of follows and so on
+func HopLevels(db *gorm.DB, pubkey string, maxHops int, maxSize int) [][]string {
+	return newGraph(pubkey).walkHops(db, maxHops, maxSize)
+}
+
+// walkHops adds everyone within maxHops follows of the member breadth first
+// and returns the pubkeys discovered at each hop
+func (g *Graph) walkHops(db *gorm.DB, maxHops int, maxSize int) [][]string {
+	var levels [][]string
+	frontier := []string{g.Pubkey}
+	for hop := 1; hop <= maxHops && len(frontier) > 0 && !g.Truncated; hop++ {
+		found := make(map[string]bool)
+		forEachEdge(db, "metadata_follows", "follow_pubkey_hex", "metadata_pubkey_hex", frontier, func(e graphEdge) {
+			if _, seen := g.index[e.Ratee]; !seen {
+				found[e.Ratee] = true
+			}
+		})
+		next := make([]string, 0, len(found))
+		for pubkey := range found {
+			next = append(next, pubkey)
+		}
+		sort.Strings(next)
+		if room := maxSize - g.Len(); len(next) > room {
+			if room < 0 {
+				room = 0
+			}
+			next = next[:room]
+			g.Truncated = true
+		}
+		for _, pubkey := range next {
+			id := g.add(pubkey, hop)
+			g.Hops = append(g.Hops, id)
+			if hop == 1 {
+				g.Follows = append(g.Follows, id)
+			}
+		}
+		levels = append(levels, next)
+		frontier = next
+	}
+	return levels
+}
+
+// Hash is a sha256 of the pubkeys, the follows and mutes between them and
+// which pubkeys have a verified nip05 if that was loaded
+func (g *Graph) Hash() string {
+	h := sha256.New()
+	for id, pubkey := range g.pubkeys {
+		h.Write([]byte(pubkey))
+		for _, list := range [][]int{g.followers[id], g.muters[id]} {
+			h.Write([]byte{'|'})
+			for _, rater := range list {
+				h.Write([]byte(g.pubkeys[rater]))
+			}
+		}
+		if g.verified != nil && g.verified[id] {
+			h.Write([]byte{'v'})
+		}
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// forEachEdge streams the rows of a join table where whereColumn is one of pubkeys.
+func forEachEdge(db *gorm.DB, table string, rateeColumn string, whereColumn string, pubkeys []string, fn func(graphEdge)) {
+	for begin := 0; begin < len(pubkeys); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+		rows, err := db.Table(table).
+			Select("metadata_pubkey_hex as rater, "+rateeColumn+" as ratee").
+			Where(whereColumn+" in ?", pubkeys[begin:end]).
+			Rows()
+		if err != nil {
+			TheLog.Printf("error loading %s for graph: %s", table, err)
+			continue
+		}
+		for rows.Next() {
+			var e graphEdge
+			if err := rows.Scan(&e.Rater, &e.Ratee); err == nil {
+				fn(e)
+			}
+		}
+		rows.Close()
+	}
+}
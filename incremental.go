@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	JobIncremental = "incremental"
+
+	// changes are collected for this long before members get rescored
+	incrementalDebounce = 30 * time.Second
+)
+
+// GraphChange is a follow or mute list that processSub changed
+type GraphChange struct {
+	Pubkey  string
+	Table   string
+	Added   []string
+	Removed []string
+}
+
+var graphChanges = make(chan GraphChange, 10000)
+
+// notifyGraphChange feeds a change to the scoring side without ever blocking processSub
+func notifyGraphChange(change GraphChange) {
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return
+	}
+	select {
+	case graphChanges <- change:
+	default:
+		TheLog.Printf("graph change feed is full, dropping change of %s for %s", change.Table, change.Pubkey)
+	}
+}
+
+// memberChanges are the raters whose lists changed and the ratees they
+// added or removed, for one member whose scores are out of date
+type memberChanges struct {
+	raters map[string]bool
+	ratees map[string]bool
+}
+
+type dirtyMembers struct {
+	mu      sync.Mutex
+	members map[string]*memberChanges
+}
+
+var dirty = dirtyMembers{members: make(map[string]*memberChanges)}
+
+func (d *dirtyMembers) mark(member string, change GraphChange) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.members[member]
+	if !ok {
+		c = &memberChanges{raters: make(map[string]bool), ratees: make(map[string]bool)}
+		d.members[member] = c
+	}
+	c.raters[change.Pubkey] = true
+	for _, p := range change.Added {
+		c.ratees[p] = true
+	}
+	for _, p := range change.Removed {
+		c.ratees[p] = true
+	}
+}
+
+// restore puts changes back that could not be applied yet
+func (d *dirtyMembers) restore(member string, changes *memberChanges) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.members[member]
+	if !ok {
+		d.members[member] = changes
+		return
+	}
+	for rater := range changes.raters {
+		c.raters[rater] = true
+	}
+	for ratee := range changes.ratees {
+		c.ratees[ratee] = true
+	}
+}
+
+// take removes and returns the pending changes of a member
+func (d *dirtyMembers) take(member string) *memberChanges {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c := d.members[member]
+	delete(d.members, member)
+	return c
+}
+
+func (d *dirtyMembers) list() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var members []string
+	for m := range d.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+// startIncrementalUpdates marks members dirty as lists change and
+// periodically enqueues incremental jobs for them
+func startIncrementalUpdates(db *gorm.DB) {
+	go func() {
+		for change := range graphChanges {
+			for _, member := range affectedMembers(db, change.Pubkey) {
+				dirty.mark(member, change)
+			}
+		}
+	}()
+	go func() {
+		for {
+			time.Sleep(incrementalDebounce)
+			for _, member := range dirty.list() {
+				if _, err := Jobs.Enqueue(JobIncremental, member); err != nil {
+					TheLog.Printf("could not enqueue incremental update for %s: %s", member, err)
+				}
+			}
+		}
+	}()
+}
+
+// affectedMembers are the members whose scores depend on rater's lists: the
+// rater itself, members following the rater and members who scored the rater
+func affectedMembers(db *gorm.DB, rater string) []string {
+	var members []string
+	db.Model(&Metadata{}).
+		Where("member = ?", true).
+		Where("pubkey_hex = ? or pubkey_hex in (?) or pubkey_hex in (?)", rater,
+			db.Table("metadata_follows").Select("metadata_pubkey_hex").Where("follow_pubkey_hex = ?", rater),
+			db.Model(&GvScore{}).Select("metadata_pubkey").Where("pubkey_hex = ?", rater)).
+		Pluck("pubkey_hex", &members)
+	return members
+}
+
+// errCalculationDeferred is returned when changes need a full calculation but
+// the member's calculate quota doesn't allow one yet
+var errCalculationDeferred = errors.New("full calculation deferred by the calculate quota")
+
+func runIncrementalJob(job Job, progress func(int)) error {
+	for {
+		changes := dirty.take(job.MetadataPubkey)
+		if changes == nil {
+			return nil
+		}
+		err := updateScoresIncremental(job.MetadataPubkey, changes, progress)
+		if errors.Is(err, errCalculationDeferred) {
+			// a later incremental job tries again once the quota allows it
+			dirty.restore(job.MetadataPubkey, changes)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fullCalculation is the fallback of an incremental update, limited by the
+// same MinCalculateInterval as requested calculations
+func fullCalculation(membership Membership, progress func(int)) error {
+	if err := checkCalculateQuota(DB, membership); err != nil {
+		TheLog.Printf("not recalculating %s yet: %s", membership.MetadataPubkey, err)
+		return errCalculationDeferred
+	}
+	return calculateWot(membership.MetadataPubkey, "", progress)
+}
+
+// updateScoresIncremental rescores only the pubkeys reachable from the changed
+// edges, starting from the stored GvScores. List changes of pubkeys closer than
+// the max hops change which pubkeys are in the graph, those fall back to a full
+// calculateWot.
+func updateScoresIncremental(pubkey string, changes *memberChanges, progress func(int)) error {
+	membership, err := GetMembership(DB, pubkey)
+	if err != nil {
+		return err
+	}
+	params := GetScoringParams(DB, pubkey)
+	if params.Algorithm != AlgorithmGrapeRank || params.Nip05Factor != 1 {
+		// only plain GrapeRank scores can be picked up from where they are stored
+		return fullCalculation(membership, progress)
+	}
+
+	var last CalculationRun
+	if DB.Where("metadata_pubkey = ? and algorithm = ?", pubkey, AlgorithmGrapeRank).Order("started_at desc").First(&last).Error != nil || last.ScoringParamsID != params.ID {
+		TheLog.Printf("no calculation with the current params for %s, running a full calculation", pubkey)
+		return fullCalculation(membership, progress)
+	}
+
+	run := CalculationRun{MetadataPubkey: pubkey, Algorithm: AlgorithmGrapeRank, StartedAt: time.Now(), Incremental: true, ScoringParamsID: params.ID}
+	graph := LoadGraph(DB, pubkey, params.MaxHops, membership.MaxGraphSize)
+	me, _ := graph.ID(pubkey)
+	if graph.Truncated {
+		return fullCalculation(membership, progress)
+	}
+	for rater := range changes.raters {
+		if id, ok := graph.ID(rater); ok && graph.Depth(id) < params.MaxHops {
+			TheLog.Printf("%s is %d hops from %s, their list changes the graph, running a full calculation", rater, graph.Depth(id), pubkey)
+			return fullCalculation(membership, progress)
+		}
+	}
+	progress(10)
+
+	// warm start from the stored scores
+	state := newGrapeRankState(graph, me, params)
+	var stored []GvScore
+	DB.Where("metadata_pubkey = ? and algorithm = ?", pubkey, AlgorithmGrapeRank).Find(&stored)
+	for _, s := range stored {
+		if id, ok := graph.ID(s.PubkeyHex); ok && id != me && state.scored[id] {
+			state.inf[id] = s.Score
+			state.avg[id] = s.Average
+			state.input[id] = s.Input
+			state.certainty[id] = s.Certainty
+		}
+	}
+
+	// rescore the ratees of the changed edges and keep going downstream while scores move
+	var queue []int
+	queued := make([]bool, graph.Len())
+	for ratee := range changes.ratees {
+		if id, ok := graph.ID(ratee); ok && state.scored[id] && id != me {
+			queue = append(queue, id)
+			queued[id] = true
+		}
+	}
+	// in graph order so the same changes always update the same way
+	sort.Ints(queue)
+	changed := make(map[int]bool)
+	maxUpdates := graph.Len() * params.MaxIterations
+	for len(queue) > 0 && run.Updates < maxUpdates {
+		id := queue[0]
+		queue = queue[1:]
+		queued[id] = false
+		run.Updates++
+
+		delta := state.update(id)
+		if delta > 0 {
+			changed[id] = true
+		}
+		if delta < params.Epsilon {
+			continue
+		}
+		for _, next := range graph.Rated(id) {
+			if !queued[next] && state.scored[next] && next != me {
+				queue = append(queue, next)
+				queued[next] = true
+			}
+		}
+	}
+	run.Converged = len(queue) == 0
+	progress(80)
+
+	for id := range changed {
+		values := map[string]interface{}{
+			"score":             state.inf[id],
+			"average":           state.avg[id],
+			"input":             state.input[id],
+			"certainty":         state.certainty[id],
+			"scoring_params_id": params.ID,
+		}
+		rows := DB.Model(&GvScore{}).Where("metadata_pubkey = ? and pubkey_hex = ? and algorithm = ?", pubkey, graph.PubkeyOf(id), AlgorithmGrapeRank).Updates(values).RowsAffected
+		if rows == 0 {
+			DB.Create(&GvScore{
+				MetadataPubkey:  pubkey,
+				PubkeyHex:       graph.PubkeyOf(id),
+				Algorithm:       AlgorithmGrapeRank,
+				Score:           state.inf[id],
+				Average:         state.avg[id],
+				Input:           state.input[id],
+				Certainty:       state.certainty[id],
+				ScoringParamsID: params.ID,
+			})
+		}
+	}
+
+	run.GraphSize = graph.Len()
+	run.FinishedAt = time.Now()
+	run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+	DB.Create(&run)
+	TheLog.Printf("incremental update for %s: %d rescores, %d changed scores, converged: %v", pubkey, run.Updates, len(changed), run.Converged)
+	return nil
+}
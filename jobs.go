@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+
+	JobCalculate = "calculate"
+	JobScrape    = "scrape"
+	JobPublish   = "publish"
+)
+
+// Job is a persisted unit of background work for a member
+type Job struct {
+	ID             uuid.UUID `gorm:"type:char(36);primary_key"`
+	Kind           string    `gorm:"size:32;index:idx_job_member_kind"`
+	MetadataPubkey string    `gorm:"size:65;index:idx_job_member_kind"`
+	State          string    `gorm:"size:32;index"`
+	// Algorithm is the Scorer a calculation uses, empty for the member's own
+	Algorithm string `gorm:"size:32;default:''"`
+	// Progress is a percentage, 0-100
+	Progress   int
+	Error      string `gorm:"size:4096"`
+	CreatedAt  time.Time
+	StartedAt  time.Time `gorm:"default:1970-01-01 00:00:00"`
+	FinishedAt time.Time `gorm:"default:1970-01-01 00:00:00"`
+}
+
+func (m *Job) BeforeCreate(tx *gorm.DB) error {
+	m.ID = uuid.New()
+	return nil
+}
+
+// JobRunner does the work for one kind of job, calling progress as it goes
+type JobRunner func(job Job, progress func(percent int)) error
+
+// JobQueue runs jobs on a bounded pool of workers. Only one job per member
+// runs at a time and a member can't have two active jobs of the same kind.
+type JobQueue struct {
+	db      *gorm.DB
+	queue   chan uuid.UUID
+	workers int
+	runners map[string]JobRunner
+	mu      sync.Mutex
+	// busy members have a running job, their other jobs wait in deferred
+	// without holding a worker and go back on the queue when it finishes
+	busy     map[string]bool
+	deferred map[string][]uuid.UUID
+}
+
+var Jobs *JobQueue
+
+func NewJobQueue(db *gorm.DB, workers int, runners map[string]JobRunner) *JobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobQueue{
+		db:       db,
+		queue:    make(chan uuid.UUID, 1000),
+		workers:  workers,
+		runners:  runners,
+		busy:     make(map[string]bool),
+		deferred: make(map[string][]uuid.UUID),
+	}
+}
+
+// Start fails jobs that were running when the process died, requeues the
+// queued ones and starts the workers.
+func (q *JobQueue) Start() {
+	q.db.Model(&Job{}).Where("state = ?", JobRunning).Updates(map[string]interface{}{
+		"state":       JobFailed,
+		"error":       "interrupted by restart",
+		"finished_at": time.Now(),
+	})
+
+	var queued []Job
+	q.db.Where("state = ?", JobQueued).Order("created_at").Find(&queued)
+	for _, j := range queued {
+		id := j.ID
+		go func() { q.queue <- id }()
+	}
+	TheLog.Printf("starting %d job workers, %d queued jobs", q.workers, len(queued))
+
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+}
+
+// Enqueue creates a job, or returns the already queued/running job of the same kind for the member
+func (q *JobQueue) Enqueue(kind string, pubkey string) (Job, error) {
+	return q.EnqueueAlgorithm(kind, pubkey, "")
+}
+
+// EnqueueAlgorithm is Enqueue for a calculation with another algorithm than
+// the member's, jobs with different algorithms don't replace each other
+func (q *JobQueue) EnqueueAlgorithm(kind string, pubkey string, algorithm string) (Job, error) {
+	if _, ok := q.runners[kind]; !ok {
+		return Job{}, fmt.Errorf("unknown job kind %s", kind)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var existing Job
+	err := q.db.Where("kind = ? and metadata_pubkey = ? and algorithm = ? and state in ?", kind, pubkey, algorithm, []string{JobQueued, JobRunning}).First(&existing).Error
+	if err == nil {
+		return existing, nil
+	}
+
+	job := Job{Kind: kind, MetadataPubkey: pubkey, State: JobQueued, Algorithm: algorithm}
+	if err := q.db.Create(&job).Error; err != nil {
+		return job, err
+	}
+	go func() { q.queue <- job.ID }()
+	return job, nil
+}
+
+// claim marks the member of a job busy, or defers the job when the member
+// already has one running
+func (q *JobQueue) claim(job Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.busy[job.MetadataPubkey] {
+		q.deferred[job.MetadataPubkey] = append(q.deferred[job.MetadataPubkey], job.ID)
+		return false
+	}
+	q.busy[job.MetadataPubkey] = true
+	return true
+}
+
+// release frees the member and requeues its deferred jobs
+func (q *JobQueue) release(pubkey string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.busy, pubkey)
+	if ids := q.deferred[pubkey]; len(ids) > 0 {
+		delete(q.deferred, pubkey)
+		go func() {
+			for _, id := range ids {
+				q.queue <- id
+			}
+		}()
+	}
+}
+
+func (q *JobQueue) work() {
+	for id := range q.queue {
+		var job Job
+		if err := q.db.First(&job, "id = ?", id).Error; err != nil || job.State != JobQueued {
+			continue
+		}
+		if !q.claim(job) {
+			continue
+		}
+		q.run(job)
+		q.release(job.MetadataPubkey)
+	}
+}
+
+func (q *JobQueue) run(job Job) {
+	q.db.Model(&job).Updates(map[string]interface{}{"state": JobRunning, "started_at": time.Now()})
+	TheLog.Printf("running %s job %s for %s", job.Kind, job.ID, job.MetadataPubkey)
+
+	progress := func(percent int) {
+		q.db.Model(&Job{}).Where("id = ?", job.ID).Update("progress", percent)
+	}
+
+	err := q.runSafely(job, progress)
+	if err != nil {
+		TheLog.Printf("%s job %s failed: %s", job.Kind, job.ID, err)
+		q.db.Model(&job).Updates(map[string]interface{}{"state": JobFailed, "error": err.Error(), "finished_at": time.Now()})
+		return
+	}
+	q.db.Model(&job).Updates(map[string]interface{}{"state": JobDone, "progress": 100, "finished_at": time.Now()})
+	TheLog.Printf("finished %s job %s for %s", job.Kind, job.ID, job.MetadataPubkey)
+}
+
+// runSafely turns a panic in a runner into a failed job instead of a dead worker
+func (q *JobQueue) runSafely(job Job, progress func(int)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return q.runners[job.Kind](job, progress)
+}
+
+func runCalculateJob(job Job, progress func(int)) error {
+	return calculateWot(job.MetadataPubkey, job.Algorithm, progress)
+}
+
+func runScrapeJob(job Job, progress func(int)) error {
+	urls := scrapeRelayUrls(DB, job.MetadataPubkey)
+	if len(urls) == 0 {
+		return errors.New("no relays enabled for this member")
+	}
+	connected := 0
+	for i, url := range urls {
+		if doRelay(DB, CTX, url, job.MetadataPubkey) {
+			connected++
+		}
+		progress((i + 1) * 50 / len(urls))
+	}
+	if connected == 0 {
+		return errors.New("could not connect to any relay")
+	}
+	scrapeOutbox(DB, CTX, job.MetadataPubkey, urls)
+	progress(100)
+	return nil
+}
+
+func runPublishJob(job Job, progress func(int)) error {
+	return publishAssertions(job.MetadataPubkey)
+}
@@ -3,27 +3,21 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 var AppInfo = "gvengine v0.0.1"
 
 var CTX = context.Background()
-var relayUrls = []string{
-	"wss://relay.damus.io",
-	"wss://profiles.nostr1.com",
-	"wss://nostr21.com",
-	"wss://relay.primal.net",
-	//"wss://purplepag.es",
-	"wss://nos.lol",
-	"wss://wot.utxo.one",
-}
 
 func main() {
 
@@ -34,50 +28,137 @@ func main() {
 		}
 	*/
 
+	config, configErr := LoadConfig()
+	if configErr != nil {
+		fmt.Printf("Error in config: %s\nexiting.\n", configErr)
+		os.Exit(1)
+	}
+	TheConfig = config
+	ReadPolicy = parseReadPolicy(TheConfig.ReadAuth)
+
 	DB = GetGormConnection()
 
 	migrateErr := DB.AutoMigrate(&Metadata{})
 	migrateErr1 := DB.AutoMigrate(&RelayStatus{})
 	migrateErr2 := DB.AutoMigrate(&WotScore{})
 	migrateErr3 := DB.AutoMigrate(&GvScore{})
+	migrateErr4 := DB.AutoMigrate(&ServiceKey{})
+	migrateErr5 := DB.AutoMigrate(&PublishedAssertion{})
+	migrateErr6 := migrateScoringParams(DB)
+	migrateErr7 := DB.AutoMigrate(&CalculationRun{})
+	migrateErr8 := DB.AutoMigrate(&Job{})
+	migrateErr9 := DB.AutoMigrate(&Membership{})
+	migrateErr10 := DB.AutoMigrate(&Schedule{})
+	migrateErr11 := DB.AutoMigrate(&RelayList{})
+	migrateErr12 := DB.AutoMigrate(&Relay{})
+	migrateErr13 := DB.AutoMigrate(&MemberRelay{})
+	migrateErr14 := DB.AutoMigrate(&Event{})
 
 	migrateErrs := []error{
 		migrateErr,
 		migrateErr1,
 		migrateErr2,
 		migrateErr3,
+		migrateErr4,
+		migrateErr5,
+		migrateErr6,
+		migrateErr7,
+		migrateErr8,
+		migrateErr9,
+		migrateErr10,
+		migrateErr11,
+		migrateErr12,
+		migrateErr13,
+		migrateErr14,
 	}
 
 	for i, err := range migrateErrs {
 		if err != nil {
-			fmt.Println("Error running a migration (%d) %s\nexiting.", i, err)
+			fmt.Printf("Error running a migration (%d) %s\nexiting.\n", i, err)
+			os.Exit(1)
+		}
+	}
+
+	// "gvengine rebuild" replays the event archive into the graph tables and exits
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		replayed, err := rebuildFromArchive(DB)
+		if err != nil {
+			fmt.Printf("Error rebuilding from the archive after %d events: %s\nexiting.\n", replayed, err)
 			os.Exit(1)
 		}
+		fmt.Printf("rebuilt from %d archived events\n", replayed)
+		os.Exit(0)
+	}
+
+	// the configured relays are only the starting point, after that they are managed through the api
+	if err := seedRelays(DB, TheConfig.Relays); err != nil {
+		fmt.Printf("Error seeding relays: %s\nexiting.\n", err)
+		os.Exit(1)
 	}
 
+	Jobs = NewJobQueue(DB, TheConfig.JobWorkers, map[string]JobRunner{
+		JobCalculate:   runCalculateJob,
+		JobScrape:      runScrapeJob,
+		JobPublish:     runPublishJob,
+		JobRefresh:     runRefreshJob,
+		JobIncremental: runIncrementalJob,
+	})
+	Jobs.Start()
+	startScheduler(DB)
+	startIncrementalUpdates(DB)
+	startRelayHealth(DB)
+	startArchivePruning(DB)
+	startNip05Verification(DB, time.Duration(TheConfig.Nip05Interval))
+
 	r := mux.NewRouter()
 	r.HandleFunc("/", HomeHandler)
-	r.HandleFunc("/api/members/{key}/gvscores/{pubkey}", GVScoresHandlerPubkey)
-	r.HandleFunc("/api/members/{key}/wotscores/{pubkey}", WotScoresHandlerPubkey)
-	r.HandleFunc("/api/members/{key}/gvscores", GVScoresHandler)
-	r.HandleFunc("/api/members/{key}/wotscores", WotScoresHandler)
-	r.HandleFunc("/api/members/{key}/calculate", CalculateScoresHandler)
-	r.HandleFunc("/api/members/{key}/scrape", ScrapeRelaysHandler)
-	r.HandleFunc("/api/members/{key}/follows", FollowsHandler)
-	r.HandleFunc("/api/members/{key}/followers", FollowersHandler)
+	r.HandleFunc("/api/members/{key}/scores:lookup", withAuth(ReadPolicy, LookupScoresHandler)).Methods("POST")
+	r.HandleFunc("/api/members/{key}/gvscores/{pubkey}", withAuth(ReadPolicy, GVScoresHandlerPubkey))
+	r.HandleFunc("/api/members/{key}/wotscores/{pubkey}", withAuth(ReadPolicy, WotScoresHandlerPubkey))
+	r.HandleFunc("/api/members/{key}/gvscores", withAuth(ReadPolicy, GVScoresHandler))
+	r.HandleFunc("/api/members/{key}/wotscores", withAuth(ReadPolicy, WotScoresHandler))
+	r.HandleFunc("/api/members/{key}/calculate", withAuth(AuthMember, CalculateScoresHandler))
+	r.HandleFunc("/api/members/{key}/scrape", withAuth(AuthMember, ScrapeRelaysHandler))
+	r.HandleFunc("/api/members/{key}/follows", withAuth(ReadPolicy, FollowsHandler))
+	r.HandleFunc("/api/members/{key}/followers", withAuth(ReadPolicy, FollowersHandler))
+	r.HandleFunc("/api/members/{key}/publish", withAuth(AuthMember, PublishAssertionsHandler))
+	r.HandleFunc("/api/members/{key}/servicekey", withAuth(ReadPolicy, ServiceKeyHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}/servicekey", withAuth(AuthMember, CreateServiceKeyHandler)).Methods("POST")
+	r.HandleFunc("/api/members/{key}/jobs/{id}", withAuth(ReadPolicy, JobHandler))
+	r.HandleFunc("/api/members/{key}/jobs", withAuth(ReadPolicy, JobsHandler))
+	r.HandleFunc("/api/members/{key}/params", withAuth(ReadPolicy, GetParamsHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}/params", withAuth(AuthMember, PutParamsHandler)).Methods("PUT")
+	r.HandleFunc("/api/members/{key}/runs/{id}", withAuth(ReadPolicy, CalculationRunHandler))
+	r.HandleFunc("/api/members/{key}/runs", withAuth(ReadPolicy, CalculationRunsHandler))
+	r.HandleFunc("/api/members/{key}", withAuth(ReadPolicy, MemberHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}", withAuth(AuthAdmin, EnrollMemberHandler)).Methods("PUT")
+	r.HandleFunc("/api/members/{key}", withAuth(AuthMember, RemoveMemberHandler)).Methods("DELETE")
+	r.HandleFunc("/api/members", withAuth(AuthAdmin, MembersHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}/schedule", withAuth(ReadPolicy, GetScheduleHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}/schedule", withAuth(AuthMember, PutScheduleHandler)).Methods("PUT")
+	r.HandleFunc("/api/schedules", withAuth(AuthAdmin, SchedulesHandler)).Methods("GET")
+	r.HandleFunc("/api/config", withAuth(AuthAdmin, ConfigHandler)).Methods("GET")
+	r.HandleFunc("/api/relays", withAuth(AuthAdmin, RelaysHandler)).Methods("GET")
+	r.HandleFunc("/api/relays", withAuth(AuthAdmin, PutRelayHandler)).Methods("PUT")
+	r.HandleFunc("/api/relays", withAuth(AuthAdmin, DeleteRelayHandler)).Methods("DELETE")
+	r.HandleFunc("/api/members/{key}/relays", withAuth(ReadPolicy, MemberRelaysHandler)).Methods("GET")
+	r.HandleFunc("/api/members/{key}/relays", withAuth(AuthMember, PutMemberRelayHandler)).Methods("PUT")
+	r.HandleFunc("/api/members/{key}/relays", withAuth(AuthMember, DeleteMemberRelayHandler)).Methods("DELETE")
+	r.HandleFunc("/api/jobs/{id}", withAuth(AuthAdmin, JobHandler))
+	r.HandleFunc("/api/jobs", withAuth(AuthAdmin, JobsHandler))
 	http.Handle("/", r)
 
 	// Where ORIGIN_ALLOWED is like `scheme://dns[:port]`, or `*` (insecure)
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"})
-	originsOk := handlers.AllowedOrigins([]string{"*"})
-	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization"})
+	originsOk := handlers.AllowedOrigins(TheConfig.CORSOrigins)
+	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS"})
 
 	srv := &http.Server{
-		Addr: "0.0.0.0:8080",
+		Addr: TheConfig.ListenAddr,
 		// Good practice to set timeouts to avoid Slowloris attacks.
-		WriteTimeout: time.Second * 15,
-		ReadTimeout:  time.Second * 15,
-		IdleTimeout:  time.Second * 60,
+		WriteTimeout: time.Duration(TheConfig.WriteTimeout),
+		ReadTimeout:  time.Duration(TheConfig.ReadTimeout),
+		IdleTimeout:  time.Duration(TheConfig.IdleTimeout),
 		Handler:      handlers.CORS(originsOk, headersOk, methodsOk)(r),
 	}
 
@@ -99,11 +180,23 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GVScoresHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	vars := mux.Vars(r)
+	p, err := parsePageParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	q := p.filter(DB.Model(&GvScore{}).Where("metadata_pubkey = ? and algorithm = ?", vars["key"], scoresAlgorithm(r, vars["key"])), "score").Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var scores []GvScore
-	DB.Where("metadata_pubkey = ?", vars["key"]).Find(&scores)
-	json.NewEncoder(w).Encode(scores)
+	p.page(q, "score", "pubkey_hex").Find(&scores)
+	n, next := p.nextCursor(len(scores), func(i int) (float64, string) { return scores[i].Score, scores[i].PubkeyHex })
+	scores = scores[:n]
+	withNip05(DB, scores)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Page{Items: scores, Total: total, NextCursor: next})
 }
 
 func GVScoresHandlerPubkey(w http.ResponseWriter, r *http.Request) {
@@ -111,16 +204,28 @@ func GVScoresHandlerPubkey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	var scores GvScore
 	TheLog.Println(vars)
-	DB.Model(&scores).Where("pubkey_hex = ? and metadata_pubkey = ?", vars["pubkey"], vars["key"]).First(&scores)
-	json.NewEncoder(w).Encode(scores)
+	DB.Model(&scores).Where("pubkey_hex = ? and metadata_pubkey = ? and algorithm = ?", vars["pubkey"], vars["key"], scoresAlgorithm(r, vars["key"])).First(&scores)
+	found := []GvScore{scores}
+	withNip05(DB, found)
+	json.NewEncoder(w).Encode(found[0])
 }
 
 func WotScoresHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
 	vars := mux.Vars(r)
+	p, err := parsePageParams(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	q := p.filter(DB.Model(&WotScore{}).Where("metadata_pubkey = ?", vars["key"]), "score").Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
 	var scores []WotScore
-	DB.Where("metadata_pubkey = ?", vars["key"]).Find(&scores)
-	json.NewEncoder(w).Encode(scores)
+	p.page(q, "score", "pubkey_hex").Find(&scores)
+	n, next := p.nextCursor(len(scores), func(i int) (float64, string) { return float64(scores[i].Score), scores[i].PubkeyHex })
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Page{Items: scores[:n], Total: total, NextCursor: next})
 }
 
 func WotScoresHandlerPubkey(w http.ResponseWriter, r *http.Request) {
@@ -131,36 +236,553 @@ func WotScoresHandlerPubkey(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(scores)
 }
 
-func CalculateScoresHandler(w http.ResponseWriter, r *http.Request) {
+// most pubkeys one lookup takes
+const maxLookupPubkeys = 1000
+
+// scoreLookup is the scores of one looked up pubkey, NotInGraph is set when the
+// member's last calculation didn't reach it and then both scores are nil
+type scoreLookup struct {
+	Pubkey     string
+	PubkeyHex  string
+	GvScore    *GvScore
+	WotScore   *int
+	NotInGraph bool
+}
+
+// LookupScoresHandler returns the GV and WoT scores of a batch of pubkeys,
+// {"Pubkeys": [hex or npub, ...]}, in the order they were sent
+func LookupScoresHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var body struct {
+		Pubkeys []string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if len(body.Pubkeys) > maxLookupPubkeys {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("at most %d pubkeys per lookup", maxLookupPubkeys)})
+		return
+	}
+	hexes := make([]string, len(body.Pubkeys))
+	for i, key := range body.Pubkeys {
+		hexes[i] = toHexPubkey(key)
+		if hexes[i] == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "not a hex pubkey or npub: " + key})
+			return
+		}
+	}
+
+	var gvScores []GvScore
+	DB.Where("metadata_pubkey = ? and algorithm = ? and pubkey_hex in ?", vars["key"], scoresAlgorithm(r, vars["key"]), hexes).Find(&gvScores)
+	withNip05(DB, gvScores)
+	gvByPubkey := make(map[string]*GvScore)
+	for i := range gvScores {
+		gvByPubkey[gvScores[i].PubkeyHex] = &gvScores[i]
+	}
+	var wotScores []WotScore
+	DB.Where("metadata_pubkey = ? and pubkey_hex in ?", vars["key"], hexes).Find(&wotScores)
+	wotByPubkey := make(map[string]*int)
+	for i := range wotScores {
+		wotByPubkey[wotScores[i].PubkeyHex] = &wotScores[i].Score
+	}
+
+	lookups := make([]scoreLookup, len(hexes))
+	for i, pubkey := range hexes {
+		gv, wot := gvByPubkey[pubkey], wotByPubkey[pubkey]
+		lookups[i] = scoreLookup{
+			Pubkey:     body.Pubkeys[i],
+			PubkeyHex:  pubkey,
+			GvScore:    gv,
+			WotScore:   wot,
+			NotInGraph: gv == nil && wot == nil,
+		}
+	}
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lookups)
+}
+
+func CalculateScoresHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	go calculateWot(vars["key"])
-	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+	membership, err := GetMembership(DB, vars["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := checkCalculateQuota(DB, membership); err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	algorithm := r.URL.Query().Get("algorithm")
+	if algorithm != "" {
+		if _, err := GetScorer(algorithm); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+	job, err := Jobs.EnqueueAlgorithm(JobCalculate, vars["key"], algorithm)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// scoresAlgorithm is the algorithm in ?algorithm= or the member's own
+func scoresAlgorithm(r *http.Request, pubkey string) string {
+	if algorithm := r.URL.Query().Get("algorithm"); algorithm != "" {
+		return algorithm
+	}
+	return GetScoringParams(DB, pubkey).Algorithm
 }
 
 func ScrapeRelaysHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	enqueueJob(w, JobScrape, vars["key"])
+}
+
+// enqueueJob starts a job for a member and writes it as the response
+func enqueueJob(w http.ResponseWriter, kind string, pubkey string) {
+	if _, err := GetMembership(DB, pubkey); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	job, err := Jobs.Enqueue(kind, pubkey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func FollowersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pubkeysPage(w, r, "metadata_pubkey_hex", "follow_pubkey_hex", vars["key"])
+}
+
+func FollowsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pubkeysPage(w, r, "follow_pubkey_hex", "metadata_pubkey_hex", vars["key"])
+}
+
+// pubkeysPage writes a page of the column of metadata_follows where whereColumn
+// is pubkey, in pubkey order. There are no scores to sort or filter by.
+func pubkeysPage(w http.ResponseWriter, r *http.Request, column string, whereColumn string, pubkey string) {
+	p, err := parsePageParams(r)
+	if err == nil && (r.URL.Query().Get("sort") != "" || p.minScore != nil || p.maxScore != nil) {
+		err = errors.New("follows are listed by pubkey, sort, min_score and max_score don't apply")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	q := DB.Table("metadata_follows").Where(whereColumn+" = ?", pubkey).Session(&gorm.Session{})
+	var total int64
+	q.Count(&total)
+	f := []string{}
+	p.page(q, "", column).Pluck(column, &f)
+	n, next := p.nextCursor(len(f), func(i int) (float64, string) { return 0, f[i] })
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(Page{Items: f[:n], Total: total, NextCursor: next})
+}
+
+func PublishAssertionsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	go func() {
-		for _, url := range relayUrls {
-			doRelay(DB, CTX, url, vars["key"])
+	enqueueJob(w, JobPublish, vars["key"])
+}
+
+// ServiceKeyHandler shows the member's service key, POST creates it
+func ServiceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var key ServiceKey
+	if err := DB.Where("metadata_pubkey = ?", vars["key"]).First(&key).Error; err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no service key yet"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"pubkey": key.PubkeyHex, "npub": serviceKeyNpub(key)})
+}
+
+// CreateServiceKeyHandler returns the member's service key, generating it on first use
+func CreateServiceKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key, err := GetOrCreateServiceKey(DB, vars["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"pubkey": key.PubkeyHex, "npub": serviceKeyNpub(key)})
+}
+
+func GetParamsHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	vars := mux.Vars(r)
+	json.NewEncoder(w).Encode(GetScoringParams(DB, vars["key"]))
+}
+
+// PutParamsHandler stores a new params set, fields missing from the body keep their current value
+func PutParamsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	params := GetScoringParams(DB, vars["key"])
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	params.MetadataPubkey = vars["key"]
+	params.CreatedAt = time.Time{}
+	if err := params.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := DB.Create(&params).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(params)
+}
+
+func CalculationRunsHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	vars := mux.Vars(r)
+	var runs []CalculationRun
+	DB.Where("metadata_pubkey = ?", vars["key"]).Order("started_at desc").Limit(100).Find(&runs)
+	json.NewEncoder(w).Encode(runs)
+}
+
+func CalculationRunHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var run CalculationRun
+	err := DB.Where("id = ? and metadata_pubkey = ?", vars["id"], vars["key"]).First(&run).Error
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "run not found"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(run)
+}
+
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var job Job
+	q := DB.Where("id = ?", vars["id"])
+	if member, ok := vars["key"]; ok {
+		q = q.Where("metadata_pubkey = ?", member)
+	}
+	err := q.First(&job).Error
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "job not found"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(job)
+}
+
+// JobsHandler lists the latest jobs, optionally filtered with ?member=, ?kind= and ?state=.
+// Under /api/members/{key} it only lists that member's jobs.
+func JobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	q := DB.Order("created_at desc").Limit(100)
+	member := r.URL.Query().Get("member")
+	if key, ok := mux.Vars(r)["key"]; ok {
+		member = key
+	}
+	if member != "" {
+		q = q.Where("metadata_pubkey = ?", member)
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		q = q.Where("state = ?", state)
+	}
+	var jobs []Job
+	q.Find(&jobs)
+	json.NewEncoder(w).Encode(jobs)
+}
+
+type memberResponse struct {
+	Metadata
+	Membership Membership
+}
+
+func MemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	membership, err := GetMembership(DB, vars["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var person Metadata
+	DB.Where("pubkey_hex = ?", vars["key"]).First(&person)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(memberResponse{Metadata: person, Membership: membership})
+}
+
+func MembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	var members []Metadata
+	DB.Where("member = ?", true).Order("pubkey_hex").Find(&members)
+	json.NewEncoder(w).Encode(members)
+}
+
+// EnrollMemberHandler makes a pubkey (hex or npub) a member, the body may set quotas
+func EnrollMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pubkey := toHexPubkey(vars["key"])
+	if pubkey == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid pubkey"})
+		return
+	}
+	membership, err := GetMembership(DB, pubkey)
+	if err != nil {
+		membership = DefaultMembership(pubkey)
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&membership); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
 		}
-	}()
+	}
+	membership.MetadataPubkey = pubkey
+	if err := membership.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := EnrollMember(DB, membership); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(membership)
+}
+
+func RemoveMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := RemoveMember(DB, vars["key"]); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
 
-func FollowersHandler(w http.ResponseWriter, r *http.Request) {
+func GetScheduleHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	vars := mux.Vars(r)
-	var f []string
-	DB.Table("metadata_follows").Select("metadata_pubkey_hex").Where("follow_pubkey_hex = ?", vars["key"]).Scan(&f)
-	json.NewEncoder(w).Encode(f)
+	json.NewEncoder(w).Encode(GetSchedule(DB, vars["key"]))
 }
 
-func FollowsHandler(w http.ResponseWriter, r *http.Request) {
+// PutScheduleHandler updates a member's schedule, fields missing from the body keep their current value
+func PutScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	membership, err := GetMembership(DB, vars["key"])
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	schedule := GetSchedule(DB, vars["key"])
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	schedule.MetadataPubkey = vars["key"]
+	if err := schedule.Validate(membership); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := DB.Save(&schedule).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+func SchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	var schedules []Schedule
+	DB.Order("next_run_at").Find(&schedules)
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TheConfig.Sanitized())
+}
+
+// RelaysHandler lists every relay with whether the pool is connected to it
+func RelaysHandler(w http.ResponseWriter, r *http.Request) {
+	var relays []Relay
+	DB.Order("priority desc, url").Find(&relays)
+	type relayState struct {
+		Relay
+		Connected bool
+	}
+	result := make([]relayState, 0, len(relays))
+	for _, relay := range relays {
+		result = append(result, relayState{Relay: relay, Connected: Pool.Connected(relay.Url)})
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// PutRelayHandler adds a relay or changes its Enabled flag and Priority, fields missing from the body keep their current value
+func PutRelayHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var relay Relay
+	if err := json.Unmarshal(body, &relay); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if err := relay.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	url := relay.Url
+	if DB.Where("url = ?", url).First(&relay).Error == nil {
+		// apply the body over the stored relay
+		createdAt := relay.CreatedAt
+		json.Unmarshal(body, &relay)
+		relay.Url = url
+		relay.CreatedAt = createdAt
+	}
+	// saving a relay is how an admin takes it back after a demotion
+	relay.Demoted = false
+	relay.DemoteReason = ""
+	if err := DB.Save(&relay).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	if !relay.Enabled {
+		Pool.Drop(relay.Url)
+	} else {
+		Pool.ResetInvalid(relay.Url)
+	}
 	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(relay)
+}
+
+// DeleteRelayHandler removes the relay in ?url= and closes its connection
+func DeleteRelayHandler(w http.ResponseWriter, r *http.Request) {
+	url := normalizeRelayURL(r.URL.Query().Get("url"))
+	result := DB.Where("url = ?", url).Delete(&Relay{})
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "relay not found"})
+		return
+	}
+	Pool.Drop(url)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
+}
+
+// MemberRelaysHandler shows the relays a member is scraped from, their overrides
+// and the status of every relay the member was scraped from, outbox relays included
+func MemberRelaysHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	var f []string
-	DB.Table("metadata_follows").Select("follow_pubkey_hex").Where("metadata_pubkey_hex = ?", vars["key"]).Scan(&f)
-	json.NewEncoder(w).Encode(f)
+	var overrides []MemberRelay
+	DB.Where("metadata_pubkey = ?", vars["key"]).Order("url").Find(&overrides)
+	var statuses []RelayStatus
+	DB.Where("metadata_pubkey = ?", vars["key"]).Order("url").Find(&statuses)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"relays":    EffectiveRelays(DB, vars["key"]),
+		"overrides": overrides,
+		"statuses":  statuses,
+	})
+}
+
+func PutMemberRelayHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if _, err := GetMembership(DB, vars["key"]); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var override MemberRelay
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	override.MetadataPubkey = vars["key"]
+	if err := override.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var existing MemberRelay
+	if DB.Where("metadata_pubkey = ? and url = ?", override.MetadataPubkey, override.Url).First(&existing).Error == nil {
+		override.CreatedAt = existing.CreatedAt
+	}
+	if err := DB.Save(&override).Error; err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(override)
+}
+
+// DeleteMemberRelayHandler removes the member's override for ?url=
+func DeleteMemberRelayHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	url := normalizeRelayURL(r.URL.Query().Get("url"))
+	result := DB.Where("metadata_pubkey = ? and url = ?", vars["key"], url).Delete(&MemberRelay{})
+	if result.Error != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": result.Error.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "override not found"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]bool{"ok": true})
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultMaxGraphSize         = 250000
+	DefaultMinCalculateInterval = 10 // minutes
+)
+
+var ErrNotMember = errors.New("pubkey is not a member")
+
+// Membership holds the quotas of a member, the Metadata.Member flag says who is one
+type Membership struct {
+	MetadataPubkey string `gorm:"primaryKey;size:65"`
+	// MaxGraphSize is the most pubkeys a calculation may load
+	MaxGraphSize int
+	// MinCalculateInterval is how many minutes must pass between calculations
+	MinCalculateInterval int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
+func DefaultMembership(pubkey string) Membership {
+	return Membership{
+		MetadataPubkey:       pubkey,
+		MaxGraphSize:         DefaultMaxGraphSize,
+		MinCalculateInterval: DefaultMinCalculateInterval,
+	}
+}
+
+func (m Membership) Validate() error {
+	if m.MaxGraphSize < 1 {
+		return errors.New("MaxGraphSize must be positive")
+	}
+	if m.MinCalculateInterval < 0 {
+		return errors.New("MinCalculateInterval can't be negative")
+	}
+	return nil
+}
+
+// GetMembership returns the quotas for a member or ErrNotMember
+func GetMembership(db *gorm.DB, pubkey string) (Membership, error) {
+	var person Metadata
+	err := db.Select("pubkey_hex", "member").Where("pubkey_hex = ?", pubkey).First(&person).Error
+	if err != nil || !person.Member {
+		return Membership{}, ErrNotMember
+	}
+	membership := DefaultMembership(pubkey)
+	db.Where("metadata_pubkey = ?", pubkey).First(&membership)
+	return membership, nil
+}
+
+// EnrollMember sets the Member flag, creating a blank Metadata if we never saw the pubkey, and stores the quotas
+func EnrollMember(db *gorm.DB, membership Membership) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		person := Metadata{
+			PubkeyHex:         membership.MetadataPubkey,
+			ContactsUpdatedAt: time.Unix(0, 0),
+			MetadataUpdatedAt: time.Unix(0, 0),
+			MutesUpdatedAt:    time.Unix(0, 0),
+		}
+		if err := tx.Omit("Follows", "Mutes").Where("pubkey_hex = ?", person.PubkeyHex).FirstOrCreate(&person).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&person).Omit("updated_at").Update("member", true).Error; err != nil {
+			return err
+		}
+		return tx.Save(&membership).Error
+	})
+}
+
+// RemoveMember clears the Member flag and the quotas, scores are kept
+func RemoveMember(db *gorm.DB, pubkey string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Metadata{}).Where("pubkey_hex = ?", pubkey).Omit("updated_at").Update("member", false).Error; err != nil {
+			return err
+		}
+		return tx.Where("metadata_pubkey = ?", pubkey).Delete(&Membership{}).Error
+	})
+}
+
+// checkCalculateQuota returns an error when the member ran a full calculation
+// too recently, incremental updates don't count
+func checkCalculateQuota(db *gorm.DB, membership Membership) error {
+	var last CalculationRun
+	err := db.Where("metadata_pubkey = ? and incremental = ?", membership.MetadataPubkey, false).Order("started_at desc").First(&last).Error
+	if err != nil {
+		return nil
+	}
+	next := last.StartedAt.Add(time.Duration(membership.MinCalculateInterval) * time.Minute)
+	if time.Now().Before(next) {
+		return fmt.Errorf("calculation quota exceeded, next calculation allowed at %s", next.Format(time.RFC3339))
+	}
+	return nil
+}
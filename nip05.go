@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	Nip05Verified = "verified"
+
+	DefaultNip05Interval = 24 * time.Hour
+
+	nip05Timeout = 10 * time.Second
+	// most bytes read from a nostr.json, some domains serve every user they have
+	nip05MaxBody = 1 << 20
+	// how often the verifier looks for identifiers due for a check, and how many it checks at once
+	nip05PollInterval = time.Minute
+	nip05BatchSize    = 200
+	nip05Workers      = 8
+)
+
+var nip05Name = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// Nip05Verifier resolves NIP-05 identifiers at /.well-known/nostr.json of their domain
+type Nip05Verifier struct {
+	Client *http.Client
+	// BaseURL replaces https://<domain> when set, to verify against a local server
+	BaseURL string
+}
+
+// Verifier checks the NIP-05 identifiers of profiles
+var Verifier = NewNip05Verifier()
+
+func NewNip05Verifier() *Nip05Verifier {
+	return &Nip05Verifier{Client: &http.Client{
+		Timeout: nip05Timeout,
+		// NIP-05: fetchers must ignore redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// parseNip05 splits an identifier into its lowercased name and domain, a bare
+// domain is the same as _@domain
+func parseNip05(identifier string) (name string, domain string, err error) {
+	identifier = strings.ToLower(strings.TrimSpace(identifier))
+	name, domain = "_", identifier
+	if at := strings.LastIndex(identifier, "@"); at >= 0 {
+		name, domain = identifier[:at], identifier[at+1:]
+	}
+	if !nip05Name.MatchString(name) {
+		return "", "", fmt.Errorf("invalid name %q", name)
+	}
+	if domain == "" || strings.ContainsAny(domain, "/?#@\\ ") {
+		return "", "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return name, domain, nil
+}
+
+// Verify checks that identifier resolves to pubkey and returns its domain
+func (v *Nip05Verifier) Verify(ctx context.Context, pubkey string, identifier string) (string, error) {
+	name, domain, err := parseNip05(identifier)
+	if err != nil {
+		return "", err
+	}
+	base := "https://" + domain
+	if v.BaseURL != "" {
+		base = strings.TrimSuffix(v.BaseURL, "/")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/.well-known/nostr.json?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return domain, err
+	}
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return domain, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return domain, fmt.Errorf("%s answered %s", domain, resp.Status)
+	}
+
+	var doc struct {
+		Names map[string]string `json:"names"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, nip05MaxBody)).Decode(&doc); err != nil {
+		return domain, fmt.Errorf("bad nostr.json: %w", err)
+	}
+	found, ok := doc.Names[name]
+	if !ok {
+		return domain, fmt.Errorf("%s is not listed by %s", name, domain)
+	}
+	if strings.ToLower(found) != pubkey {
+		return domain, errors.New("nip05 belongs to another pubkey")
+	}
+	return domain, nil
+}
+
+// verifyNip05 checks the identifier of one profile and records the result
+func verifyNip05(db *gorm.DB, ctx context.Context, pubkey string, identifier string) {
+	domain, err := Verifier.Verify(ctx, pubkey, identifier)
+	status := Nip05Verified
+	if err != nil {
+		status = "failed: " + err.Error()
+		if len(status) > 512 {
+			status = status[:512]
+		}
+	}
+	// the profile may have changed its nip05 meanwhile, then this result is stale
+	db.Model(&Metadata{}).Where("pubkey_hex = ? and nip05 = ?", pubkey, identifier).Omit("updated_at").Updates(map[string]interface{}{
+		"nip05_status":     status,
+		"nip05_domain":     domain,
+		"nip05_checked_at": time.Now(),
+	})
+}
+
+// startNip05Verification checks new identifiers and rechecks the others once
+// their last check is older than the interval, 0 turns verification off
+func startNip05Verification(db *gorm.DB, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			var due []Metadata
+			db.Select("pubkey_hex", "nip05").
+				Where("nip05 <> ? and nip05_checked_at < ?", "", time.Now().Add(-interval)).
+				Order("nip05_checked_at").Limit(nip05BatchSize).Find(&due)
+
+			work := make(chan Metadata)
+			var wg sync.WaitGroup
+			for i := 0; i < nip05Workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for m := range work {
+						verifyNip05(db, CTX, m.PubkeyHex, m.Nip05)
+					}
+				}()
+			}
+			for _, m := range due {
+				work <- m
+			}
+			close(work)
+			wg.Wait()
+			if len(due) > 0 {
+				TheLog.Printf("checked %d nip05 identifiers", len(due))
+			}
+			if len(due) < nip05BatchSize {
+				time.Sleep(nip05PollInterval)
+			}
+		}
+	}()
+}
+
+// loadNip05 marks the pubkeys of the graph with a verified nip05
+func (g *Graph) loadNip05(db *gorm.DB) {
+	g.verified = make([]bool, g.Len())
+	for begin := 0; begin < g.Len(); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > g.Len() {
+			end = g.Len()
+		}
+		var verified []string
+		db.Model(&Metadata{}).Where("pubkey_hex in ? and nip05_status = ?", g.pubkeys[begin:end], Nip05Verified).Pluck("pubkey_hex", &verified)
+		for _, pubkey := range verified {
+			g.verified[g.index[pubkey]] = true
+		}
+	}
+}
+
+// applyNip05Factor scales the scores of pubkeys without a verified nip05 by
+// the member's Nip05Factor, the member itself is left alone
+func applyNip05Factor(graph *Graph, seed int, params ScoringParams, result ScoreResult) {
+	for id, s := range result.Scores {
+		if id != seed && !graph.verified[id] {
+			s.Score *= params.Nip05Factor
+			result.Scores[id] = s
+		}
+	}
+}
+
+// nip05Of returns the nip05 and whether it is verified for each of pubkeys
+func nip05Of(db *gorm.DB, pubkeys []string) map[string]Metadata {
+	profiles := make(map[string]Metadata)
+	for begin := 0; begin < len(pubkeys); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+		var found []Metadata
+		db.Select("pubkey_hex", "nip05", "nip05_status").Where("pubkey_hex in ?", pubkeys[begin:end]).Find(&found)
+		for _, m := range found {
+			profiles[m.PubkeyHex] = m
+		}
+	}
+	return profiles
+}
+
+// withNip05 fills in the nip05 of the scored pubkeys for score responses
+func withNip05(db *gorm.DB, scores []GvScore) {
+	pubkeys := make([]string, len(scores))
+	for i, s := range scores {
+		pubkeys[i] = s.PubkeyHex
+	}
+	profiles := nip05Of(db, pubkeys)
+	for i := range scores {
+		m := profiles[scores[i].PubkeyHex]
+		scores[i].Nip05 = m.Nip05
+		scores[i].Nip05Verified = m.Nip05Status == Nip05Verified
+	}
+}
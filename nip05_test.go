@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNip05Verify(t *testing.T) {
+	pubkey := strings.Repeat("ab", 32)
+	other := strings.Repeat("cd", 32)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/nostr.json", func(w http.ResponseWriter, r *http.Request) {
+		switch name := r.URL.Query().Get("name"); name {
+		case "redirected":
+			http.Redirect(w, r, "/moved/nostr.json", http.StatusFound)
+		case "big":
+			// the name comes after more than the verifier reads
+			w.Write([]byte(`{"names": {"padding": "` + strings.Repeat("x", nip05MaxBody) + `", "big": "` + pubkey + `"}}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]map[string]string{"names": {
+				"bob":   pubkey,
+				"_":     pubkey,
+				"alice": other,
+			}})
+		}
+	})
+	// following the redirect would verify
+	mux.HandleFunc("/moved/nostr.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]map[string]string{"names": {"redirected": pubkey}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	v := NewNip05Verifier()
+	v.BaseURL = srv.URL
+
+	// err is part of the error, empty when the identifier verifies
+	tests := []struct {
+		identifier string
+		err        string
+	}{
+		{"bob@example.com", ""},
+		{"BOB@Example.com", ""},
+		{"example.com", ""},
+		{"alice@example.com", "another pubkey"},
+		{"carol@example.com", "not listed"},
+		{"redirected@example.com", "302"},
+		{"big@example.com", "bad nostr.json"},
+		{"bad name@example.com", "invalid name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identifier, func(t *testing.T) {
+			domain, err := v.Verify(context.Background(), pubkey, tt.identifier)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("not verified: %s", err)
+				}
+				if domain != "example.com" {
+					t.Errorf("domain %q, want example.com", domain)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"gorm.io/gorm"
+)
+
+// NIP-85 trusted assertion about a pubkey (addressable, d tag is the rated pubkey)
+const KindTrustedAssertion = 30382
+
+// ServiceKey is the keypair gvengine signs a member's trusted assertions with.
+// Clients trust the service pubkey, not the member's own key.
+type ServiceKey struct {
+	MetadataPubkey string `gorm:"primaryKey;size:65"`
+	PubkeyHex      string `gorm:"size:65"`
+	PrivateKeyHex  string `gorm:"size:65" json:"-"`
+	CreatedAt      time.Time
+}
+
+// PublishedAssertion remembers the last rank we published for each rated pubkey
+// so that unchanged scores are not re-published.
+type PublishedAssertion struct {
+	ID             uuid.UUID `gorm:"type:char(36);primary_key"`
+	MetadataPubkey string    `gorm:"size:65;index:idx_assertion_member_pubkey"`
+	PubkeyHex      string    `gorm:"size:65;index:idx_assertion_member_pubkey"`
+	Rank           int
+	EventID        string    `gorm:"size:65"`
+	PublishedAt    time.Time `gorm:"autoUpdateTime"`
+}
+
+func (m *PublishedAssertion) BeforeCreate(tx *gorm.DB) error {
+	m.ID = uuid.New()
+	return nil
+}
+
+// relays to publish trusted assertions to, the scrape relays unless nip85_relays is set
+func assertionRelayUrls() []string {
+	if len(TheConfig.NIP85Relays) == 0 {
+		return TheConfig.Relays
+	}
+	return TheConfig.NIP85Relays
+}
+
+// GetOrCreateServiceKey returns the signing key for a member, generating one on first use.
+func GetOrCreateServiceKey(db *gorm.DB, pubkey string) (ServiceKey, error) {
+	var key ServiceKey
+	err := db.Where("metadata_pubkey = ?", pubkey).First(&key).Error
+	if err == nil {
+		return key, nil
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return key, err
+	}
+	key = ServiceKey{MetadataPubkey: pubkey, PubkeyHex: pk, PrivateKeyHex: sk}
+	err = db.Create(&key).Error
+	return key, err
+}
+
+// scoreToRank converts an influence score (0..1) to a NIP-85 rank (0..100)
+func scoreToRank(score float64) int {
+	return int(math.Round(score * 100))
+}
+
+func newAssertionEvent(pubkey string, rank int) nostr.Event {
+	return nostr.Event{
+		Kind:      KindTrustedAssertion,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"d", pubkey},
+			{"rank", strconv.Itoa(rank)},
+		},
+		Content: "",
+	}
+}
+
+// publishAssertions signs a kind 30382 event for every GvScore of a member whose rank
+// changed since the last publish, plus a rank 0 event for pubkeys that dropped out of
+// the scores, and sends them to the assertion relays.
+func publishAssertions(pubkey string) error {
+	key, err := GetOrCreateServiceKey(DB, pubkey)
+	if err != nil {
+		TheLog.Printf("could not get service key for %s: %s", pubkey, err)
+		return err
+	}
+
+	// zero influence scores are stored for their certainty but are not worth asserting
+	var scores []GvScore
+	DB.Where("metadata_pubkey = ? and algorithm = ? and score > 0", pubkey, GetScoringParams(DB, pubkey).Algorithm).Find(&scores)
+
+	var published []PublishedAssertion
+	DB.Where("metadata_pubkey = ?", pubkey).Find(&published)
+	publishedRanks := make(map[string]PublishedAssertion)
+	for _, p := range published {
+		publishedRanks[p.PubkeyHex] = p
+	}
+
+	changed := make(map[string]int)
+	for _, s := range scores {
+		rank := scoreToRank(s.Score)
+		if p, ok := publishedRanks[s.PubkeyHex]; ok && p.Rank == rank {
+			continue
+		}
+		changed[s.PubkeyHex] = rank
+	}
+	// scores that no longer exist get withdrawn with a zero rank
+	current := make(map[string]bool)
+	for _, s := range scores {
+		current[s.PubkeyHex] = true
+	}
+	for pk, p := range publishedRanks {
+		if !current[pk] && p.Rank != 0 {
+			changed[pk] = 0
+		}
+	}
+
+	TheLog.Printf("publishing %d changed trusted assertions (of %d scores) for %s", len(changed), len(scores), pubkey)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var relays []*nostr.Relay
+	for _, url := range assertionRelayUrls() {
+		relay, err := nostr.RelayConnect(CTX, url)
+		if err != nil {
+			TheLog.Printf("failed connection to assertion relay: %s, %s; skipping relay", url, err)
+			continue
+		}
+		relays = append(relays, relay)
+	}
+	defer func() {
+		for _, r := range relays {
+			r.Close()
+		}
+	}()
+	if len(relays) == 0 {
+		TheLog.Printf("no assertion relays available, not publishing for %s", pubkey)
+		return errors.New("no assertion relays available")
+	}
+
+	for pk, rank := range changed {
+		ev := newAssertionEvent(pk, rank)
+		if err := ev.Sign(key.PrivateKeyHex); err != nil {
+			TheLog.Printf("error signing assertion for %s: %s", pk, err)
+			continue
+		}
+
+		ok := false
+		for _, r := range relays {
+			if err := r.Publish(CTX, ev); err != nil {
+				TheLog.Printf("error publishing assertion to %s: %s", r.URL, err)
+			} else {
+				ok = true
+			}
+		}
+		// only remember it if at least one relay accepted it, so it gets retried next time
+		if !ok {
+			continue
+		}
+
+		if p, found := publishedRanks[pk]; found {
+			DB.Model(&p).Updates(map[string]interface{}{"rank": rank, "event_id": ev.ID})
+		} else {
+			DB.Create(&PublishedAssertion{MetadataPubkey: pubkey, PubkeyHex: pk, Rank: rank, EventID: ev.ID})
+		}
+	}
+	TheLog.Printf("done publishing trusted assertions for %s", pubkey)
+	return nil
+}
+
+func serviceKeyNpub(key ServiceKey) string {
+	npub, err := nip19.EncodePublicKey(key.PubkeyHex)
+	if err != nil {
+		return ""
+	}
+	return npub
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+)
+
+const (
+	KindRelayList = 10002
+
+	DefaultOutboxMinCoverage    = 2
+	DefaultOutboxMaxRelays      = 20
+	DefaultOutboxMaxConnections = 50
+	DefaultOutboxIdleTimeout    = time.Hour
+
+	// how long the outbox pass waits for the relays of one hop to send their stored events
+	outboxEOSETimeout = time.Minute
+)
+
+// RelayList is the latest NIP-65 relay list of a pubkey
+type RelayList struct {
+	PubkeyHex   string   `gorm:"primaryKey;size:65"`
+	ReadRelays  []string `gorm:"serializer:json;type:text"`
+	WriteRelays []string `gorm:"serializer:json;type:text"`
+	// EventCreatedAt is the created_at of the kind 10002 event, newer events win
+	EventCreatedAt time.Time `gorm:"default:1970-01-01 00:00:00"`
+	UpdatedAt      time.Time
+}
+
+// normalizeRelayURL returns the normalized websocket url or "" if it is not one
+func normalizeRelayURL(url string) string {
+	url = nostr.NormalizeURL(strings.TrimSpace(url))
+	if !strings.HasPrefix(url, "wss://") && !strings.HasPrefix(url, "ws://") {
+		return ""
+	}
+	return url
+}
+
+// saveRelayList stores the r tags of a kind 10002 event, older events are ignored
+func saveRelayList(db *gorm.DB, ev *nostr.Event) {
+	var existing RelayList
+	if db.Where("pubkey_hex = ?", ev.PubKey).First(&existing).Error == nil && !existing.EventCreatedAt.Before(ev.CreatedAt.Time()) {
+		TheLog.Println("skipping old relay list for " + ev.PubKey)
+		return
+	}
+
+	list := RelayList{PubkeyHex: ev.PubKey, EventCreatedAt: ev.CreatedAt.Time(), ReadRelays: []string{}, WriteRelays: []string{}}
+	seen := make(map[string]bool)
+	for _, tag := range ev.Tags.GetAll([]string{"r"}) {
+		if len(tag) < 2 {
+			continue
+		}
+		url := normalizeRelayURL(tag[1])
+		if url == "" || seen[url] {
+			continue
+		}
+		seen[url] = true
+		// no marker means the relay is used for both
+		marker := ""
+		if len(tag) >= 3 {
+			marker = tag[2]
+		}
+		if marker == "" || marker == "read" {
+			list.ReadRelays = append(list.ReadRelays, url)
+		}
+		if marker == "" || marker == "write" {
+			list.WriteRelays = append(list.WriteRelays, url)
+		}
+	}
+
+	if err := db.Save(&list).Error; err != nil {
+		TheLog.Printf("Error saving relay list for %s: %s", ev.PubKey, err)
+	}
+}
+
+// outboxRoutes picks the relays to read authors from according to their write
+// relays. Relays in defaults are connected anyway and count towards an author's
+// coverage for free, other relays are chosen greedily by how many uncovered
+// authors they serve until every author is on minCoverage of their write
+// relays or maxRelays extra relays are used. Relays an admin disabled are never
+// picked. Authors without a relay list are left to the defaults. The result maps relay urls (never a default) to authors.
+func outboxRoutes(db *gorm.DB, authors []string, defaults []string, minCoverage int, maxRelays int) map[string][]string {
+	isDefault := make(map[string]bool)
+	for _, url := range defaults {
+		isDefault[normalizeRelayURL(url)] = true
+	}
+	disabled := disabledRelays(db)
+
+	// authors that still need coverage, by the extra relays that can provide it
+	need := make(map[string]int)
+	candidates := make(map[string][]string)
+	for begin := 0; begin < len(authors); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > len(authors) {
+			end = len(authors)
+		}
+		var lists []RelayList
+		db.Where("pubkey_hex in ?", authors[begin:end]).Find(&lists)
+		for _, list := range lists {
+			wanted := minCoverage
+			if len(list.WriteRelays) < wanted {
+				wanted = len(list.WriteRelays)
+			}
+			for _, url := range list.WriteRelays {
+				if isDefault[url] {
+					wanted--
+				}
+			}
+			if wanted <= 0 {
+				continue
+			}
+			need[list.PubkeyHex] = wanted
+			for _, url := range list.WriteRelays {
+				if !isDefault[url] && !disabled[url] {
+					candidates[url] = append(candidates[url], list.PubkeyHex)
+				}
+			}
+		}
+	}
+
+	routes := make(map[string][]string)
+	for len(routes) < maxRelays {
+		best := ""
+		bestCount := 0
+		for url, served := range candidates {
+			count := 0
+			for _, author := range served {
+				if need[author] > 0 {
+					count++
+				}
+			}
+			// ties go to the alphabetically first relay so routes are stable
+			if count > bestCount || (count == bestCount && count > 0 && url < best) {
+				best = url
+				bestCount = count
+			}
+		}
+		if bestCount == 0 {
+			break
+		}
+		// read every author the relay has from it, not just the ones that still needed it
+		routes[best] = candidates[best]
+		for _, author := range candidates[best] {
+			need[author]--
+		}
+		delete(candidates, best)
+	}
+
+	uncovered := 0
+	for _, n := range need {
+		if n > 0 {
+			uncovered++
+		}
+	}
+	if uncovered > 0 {
+		TheLog.Printf("outbox: %d of %d authors below coverage %d with %d extra relays", uncovered, len(authors), minCoverage, maxRelays)
+	}
+	return routes
+}
+
+// scrapeOutbox reads the member's graph from the write relays of its authors,
+// one hop at a time after the default relays sent what they have, so lists
+// found on an author's own relays feed the next hop. Connections are reused
+// between hops and kept by the pool for live updates until they are idle.
+func scrapeOutbox(db *gorm.DB, ctx context.Context, pubkey string, defaults []string) {
+	params := GetScoringParams(db, pubkey)
+	maxSize := DefaultMaxGraphSize
+	if membership, err := GetMembership(db, pubkey); err == nil {
+		maxSize = membership.MaxGraphSize
+	}
+	minCoverage := TheConfig.OutboxMinCoverage
+	maxRelays := TheConfig.OutboxMaxRelays
+	if maxRelays == 0 {
+		return
+	}
+
+	connected := make(map[string]bool)
+	failed := make(map[string]bool)
+	for hop := 0; hop < params.MaxHops; hop++ {
+		waitForEOSE(db, pubkey, outboxEOSETimeout)
+
+		authors := []string{pubkey}
+		if hop > 0 {
+			levels := HopLevels(db, pubkey, hop, maxSize)
+			if len(levels) < hop || len(levels[hop-1]) == 0 {
+				return
+			}
+			authors = levels[hop-1]
+		}
+
+		kinds := []int{3, 10000, KindRelayList}
+		if hop <= 1 {
+			kinds = []int{3, 0, 10000, KindRelayList}
+		}
+
+		routes := outboxRoutes(db, authors, defaults, minCoverage, maxRelays)
+		urls := make([]string, 0, len(routes))
+		for url := range routes {
+			urls = append(urls, url)
+		}
+		sort.Strings(urls)
+		TheLog.Printf("outbox: %d authors at hop %d for %s routed to %d relays", len(authors), hop+1, pubkey, len(urls))
+
+		for _, url := range urls {
+			if !connected[url] {
+				// the cap is on connections, a relay picked again for a later hop is free
+				if failed[url] || len(connected) >= maxRelays {
+					continue
+				}
+				if err := Pool.ConnectOutbox(ctx, url); err != nil {
+					TheLog.Printf("outbox: failed connection to relay: %s, %s; skipping relay", url, err)
+					failed[url] = true
+					continue
+				}
+				connected[url] = true
+			}
+			UpdateOrCreateRelayStatus(db, url, "connection established: outbox", pubkey)
+
+			// pick up where we left off on this relay, like doRelay
+			var since nostr.Timestamp
+			var rs RelayStatus
+			if db.Where("url = ? and metadata_pubkey = ?", url, pubkey).First(&rs).Error == nil && rs.LastEOSE.After(time.Unix(0, 0)) {
+				since = nostr.Timestamp(rs.LastEOSE.Unix())
+			}
+			if err := Pool.Request(url, pubkey, kinds, authorSince(db, routes[url], since), nil); err != nil {
+				TheLog.Printf("outbox: error subscribing on %s: %s", url, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import "math"
+
+// pageRankScorer is personalized PageRank: a random walk along follows that
+// jumps back to the seed with probability 1 - Damping at every step and from
+// pubkeys that follow nobody in the graph. Mutes are not used. Scores are
+// scaled so the highest one is 1.
+type pageRankScorer struct{}
+
+func (pageRankScorer) Score(graph *Graph, seed int, params ScoringParams, progress func(percent int)) ScoreResult {
+	var result ScoreResult
+	n := graph.Len()
+
+	outDegree := make([]int, n)
+	for id := 0; id < n; id++ {
+		for _, follower := range graph.Followers(id) {
+			outDegree[follower]++
+		}
+	}
+
+	rank := make([]float64, n)
+	next := make([]float64, n)
+	rank[seed] = 1.0
+	for i := 0; i < params.MaxIterations; i++ {
+		// the walks that end at a pubkey without follows restart at the seed
+		dangling := 0.0
+		for id := 0; id < n; id++ {
+			if outDegree[id] == 0 {
+				dangling += rank[id]
+			}
+		}
+		for id := 0; id < n; id++ {
+			sum := 0.0
+			for _, follower := range graph.Followers(id) {
+				sum += rank[follower] / float64(outDegree[follower])
+			}
+			next[id] = params.Damping * sum
+		}
+		next[seed] += 1 - params.Damping + params.Damping*dangling
+
+		delta := 0.0
+		for id := 0; id < n; id++ {
+			delta += math.Abs(next[id] - rank[id])
+		}
+		rank, next = next, rank
+		result.Deltas = append(result.Deltas, delta)
+		result.Iterations = i + 1
+		progress(100 * result.Iterations / params.MaxIterations)
+		TheLog.Printf("calculated pagerank iteration %d, delta %f\n", i, delta)
+		if delta < params.Epsilon {
+			result.Converged = true
+			break
+		}
+	}
+
+	highest := 0.0
+	for _, r := range rank {
+		highest = math.Max(highest, r)
+	}
+	result.Scores = make(map[int]PubkeyScore)
+	for _, id := range append([]int{seed}, graph.Hops...) {
+		score := 0.0
+		if highest > 0 {
+			score = rank[id] / highest
+		}
+		result.Scores[id] = PubkeyScore{Score: score}
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// Page is one page of a list endpoint. Pass NextCursor as ?cursor= for the
+// next page, it is empty on the last one. Total counts every item matching the
+// filters across all pages.
+type Page struct {
+	Items      interface{}
+	Total      int64
+	NextCursor string
+}
+
+// pageParams are the ?limit=, ?cursor=, ?sort=, ?min_score= and ?max_score= of a list request
+type pageParams struct {
+	limit     int
+	ascending bool
+	minScore  *float64
+	maxScore  *float64
+	// the cursor is the score and pubkey of the last item of the previous page
+	cursor      bool
+	afterScore  float64
+	afterPubkey string
+}
+
+// parsePageParams reads the paging query, sorted by score the highest first unless ?sort=score_asc
+func parsePageParams(r *http.Request) (pageParams, error) {
+	query := r.URL.Query()
+	p := pageParams{limit: defaultPageLimit}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return p, errors.New("limit must be between 1 and " + strconv.Itoa(maxPageLimit))
+		}
+		p.limit = limit
+	}
+	switch query.Get("sort") {
+	case "", "score_desc":
+	case "score_asc":
+		p.ascending = true
+	default:
+		return p, errors.New("sort must be score_desc or score_asc")
+	}
+	for _, f := range []struct {
+		name  string
+		value **float64
+	}{{"min_score", &p.minScore}, {"max_score", &p.maxScore}} {
+		if v := query.Get(f.name); v != "" {
+			score, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return p, errors.New(f.name + " must be a number")
+			}
+			*f.value = &score
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if err := p.decodeCursor(v); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func encodeCursor(score float64, pubkey string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatFloat(score, 'g', -1, 64) + ":" + pubkey))
+}
+
+func (p *pageParams) decodeCursor(cursor string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return errors.New("invalid cursor")
+	}
+	score, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return errors.New("invalid cursor")
+	}
+	p.cursor, p.afterScore, p.afterPubkey = true, score, parts[1]
+	return nil
+}
+
+// filter applies the score filters, the total is counted after this
+func (p pageParams) filter(q *gorm.DB, scoreColumn string) *gorm.DB {
+	if p.minScore != nil {
+		q = q.Where(scoreColumn+" >= ?", *p.minScore)
+	}
+	if p.maxScore != nil {
+		q = q.Where(scoreColumn+" <= ?", *p.maxScore)
+	}
+	return q
+}
+
+// page continues after the cursor in score order, pubkeys break ties in the
+// same direction so the (member, score, pubkey) indexes serve the whole order.
+// One row more than the limit is read to tell whether there is a next page.
+// Without a scoreColumn the list is in pubkey order.
+func (p pageParams) page(q *gorm.DB, scoreColumn string, pubkeyColumn string) *gorm.DB {
+	if scoreColumn == "" {
+		if p.cursor {
+			q = q.Where(pubkeyColumn+" > ?", p.afterPubkey)
+		}
+		return q.Order(pubkeyColumn).Limit(p.limit + 1)
+	}
+
+	direction, past := "desc", "<"
+	if p.ascending {
+		direction, past = "asc", ">"
+	}
+	if p.cursor {
+		q = q.Where("("+scoreColumn+" "+past+" ? or ("+scoreColumn+" = ? and "+pubkeyColumn+" "+past+" ?))", p.afterScore, p.afterScore, p.afterPubkey)
+	}
+	return q.Order(scoreColumn + " " + direction).Order(pubkeyColumn + " " + direction).Limit(p.limit + 1)
+}
+
+// nextCursor trims the extra row page read and returns how many items to keep
+// and the cursor after the last of them, empty when there are no more
+func (p pageParams) nextCursor(count int, keyOf func(i int) (float64, string)) (int, string) {
+	if count <= p.limit {
+		return count, ""
+	}
+	score, pubkey := keyOf(p.limit - 1)
+	return p.limit, encodeCursor(score, pubkey)
+}
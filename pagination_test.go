@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// testPageScores has runs of equal scores, so pages end in the middle of ties
+var testPageScores = []float64{0.5, 0.2, 0.9, 0.2, 0.5, 0.2, 0.1, 0.2, 0.5, 0.9, 0.2, 0.1, 0.5, 0.2, 0}
+
+func TestScorePagesOverTies(t *testing.T) {
+	db := openTestDB(t)
+	member := testPubkey(1000)
+	for i, score := range testPageScores {
+		db.Create(&GvScore{ID: uuid.New(), MetadataPubkey: member, PubkeyHex: testPubkey(i), Algorithm: AlgorithmGrapeRank, Score: score})
+		// neither another algorithm nor another member shows up
+		db.Create(&GvScore{ID: uuid.New(), MetadataPubkey: member, PubkeyHex: testPubkey(i), Algorithm: AlgorithmPageRank, Score: score})
+		db.Create(&GvScore{ID: uuid.New(), MetadataPubkey: testPubkey(1001), PubkeyHex: testPubkey(i), Algorithm: AlgorithmGrapeRank, Score: score})
+	}
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		min, max float64
+	}{
+		{"desc", url.Values{}, 0, 1},
+		{"asc", url.Values{"sort": {"score_asc"}}, 0, 1},
+		{"desc min", url.Values{"min_score": {"0.2"}}, 0.2, 1},
+		{"asc max", url.Values{"sort": {"score_asc"}, "max_score": {"0.5"}}, 0, 0.5},
+		{"desc min max", url.Values{"min_score": {"0.1"}, "max_score": {"0.5"}}, 0.1, 0.5},
+		{"asc min max", url.Values{"sort": {"score_asc"}, "min_score": {"0.2"}, "max_score": {"0.5"}}, 0.2, 0.5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := 0
+			for _, score := range testPageScores {
+				if score >= tt.min && score <= tt.max {
+					want++
+				}
+			}
+			ascending := tt.query.Get("sort") == "score_asc"
+
+			seen := make(map[string]bool)
+			var last *GvScore
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > len(testPageScores) {
+					t.Fatal("paging doesn't end")
+				}
+				query := url.Values{"limit": {"3"}}
+				for k, v := range tt.query {
+					query[k] = v
+				}
+				if cursor != "" {
+					query.Set("cursor", cursor)
+				}
+				r := httptest.NewRequest("GET", "/api/members/"+member+"/gvscores?"+query.Encode(), nil)
+				r = mux.SetURLVars(r, map[string]string{"key": member})
+				w := httptest.NewRecorder()
+				GVScoresHandler(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				var page struct {
+					Items      []GvScore
+					Total      int64
+					NextCursor string
+				}
+				if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != int64(want) {
+					t.Errorf("page %d: total %d, want %d", pages, page.Total, want)
+				}
+				for i := range page.Items {
+					s := page.Items[i]
+					if s.Score < tt.min || s.Score > tt.max {
+						t.Errorf("%s: score %v outside the filter", s.PubkeyHex, s.Score)
+					}
+					if seen[s.PubkeyHex] {
+						t.Errorf("%s on more than one page", s.PubkeyHex)
+					}
+					seen[s.PubkeyHex] = true
+					if last != nil {
+						if ascending && (s.Score < last.Score || s.Score == last.Score && s.PubkeyHex < last.PubkeyHex) ||
+							!ascending && (s.Score > last.Score || s.Score == last.Score && s.PubkeyHex > last.PubkeyHex) {
+							t.Errorf("%s (%v) after %s (%v)", s.PubkeyHex, s.Score, last.PubkeyHex, last.Score)
+						}
+					}
+					last = &s
+				}
+				if page.NextCursor == "" {
+					break
+				}
+				cursor = page.NextCursor
+			}
+			if len(seen) != want {
+				t.Errorf("paged through %d scores, want %d", len(seen), want)
+			}
+		})
+	}
+}
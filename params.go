@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ScoringParams are the scoring algorithm and its knobs for a member. Rows are never
+// updated, every change stores a new set so GvScores can point at the set that produced them.
+type ScoringParams struct {
+	ID             uuid.UUID `gorm:"type:char(36);primary_key"`
+	MetadataPubkey string    `gorm:"size:65;index"`
+	// Algorithm is the Scorer used unless a calculation asks for another one
+	Algorithm string `gorm:"size:32;default:graperank"`
+
+	// GrapeRank
+	AttenuationFactor              float64
+	Rigor                          float64
+	DefaultUserScore               float64
+	DefaultUserConfidence          float64
+	FollowInterpretationScore      float64
+	FollowInterpretationConfidence float64
+	MuteInterpretationScore        float64
+	MuteInterpretationConfidence   float64
+	// iterate until the largest influence change in a cycle is below Epsilon,
+	// but never more than MaxIterations cycles
+	Epsilon       float64
+	MaxIterations int
+	// Damping is the chance a PageRank walk follows a follow instead of jumping back to the member
+	Damping float64 `gorm:"default:0.85"`
+	// Nip05Factor scales the scores of pubkeys without a verified nip05, 1 ignores nip05
+	Nip05Factor float64
+	// MaxHops is how many follows away from the member we scrape and score, 1-4
+	MaxHops   int `gorm:"default:2"`
+	CreatedAt time.Time
+}
+
+func (m *ScoringParams) BeforeCreate(tx *gorm.DB) error {
+	m.ID = uuid.New()
+	return nil
+}
+
+// migrateScoringParams migrates the table and backfills columns added since sets
+// were first stored: sets from before Epsilon and MaxIterations get the default
+// Epsilon and keep their Iterations as MaxIterations, sets from before Nip05Factor
+// get 1 so they keep ignoring nip05. The columns have no default as gorm would
+// store that for a 0 too.
+func migrateScoringParams(db *gorm.DB) error {
+	migrator := db.Migrator()
+	hadEpsilon := migrator.HasColumn(&ScoringParams{}, "Epsilon")
+	hadMaxIterations := migrator.HasColumn(&ScoringParams{}, "MaxIterations")
+	hadNip05Factor := migrator.HasColumn(&ScoringParams{}, "Nip05Factor")
+	if err := db.AutoMigrate(&ScoringParams{}); err != nil {
+		return err
+	}
+	defaults := DefaultScoringParams("")
+	if !hadEpsilon {
+		if err := db.Model(&ScoringParams{}).Where("1 = 1").Update("epsilon", defaults.Epsilon).Error; err != nil {
+			return err
+		}
+	}
+	if !hadMaxIterations {
+		if err := db.Model(&ScoringParams{}).Where("1 = 1").Update("max_iterations", defaults.MaxIterations).Error; err != nil {
+			return err
+		}
+		if migrator.HasColumn(&ScoringParams{}, "iterations") {
+			err := db.Model(&ScoringParams{}).Where("iterations between 1 and 100").Update("max_iterations", gorm.Expr("iterations")).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !hadNip05Factor {
+		return db.Model(&ScoringParams{}).Where("1 = 1").Update("nip05_factor", 1).Error
+	}
+	return nil
+}
+
+// DefaultScoringParams are used for members that never set their own,
+// they have a nil ID.
+func DefaultScoringParams(pubkey string) ScoringParams {
+	return ScoringParams{
+		MetadataPubkey:                 pubkey,
+		Algorithm:                      AlgorithmGrapeRank,
+		AttenuationFactor:              80.0 / 100.0,
+		Rigor:                          25.0 / 100.0,
+		DefaultUserScore:               0.0,
+		DefaultUserConfidence:          0.0,
+		FollowInterpretationScore:      100.0 / 100.0,
+		FollowInterpretationConfidence: 5.0 / 100.0,
+		MuteInterpretationScore:        0.0 / 100.0,
+		MuteInterpretationConfidence:   10.0 / 100.0,
+		Epsilon:                        0.0001,
+		MaxIterations:                  50,
+		Damping:                        0.85,
+		Nip05Factor:                    1,
+		MaxHops:                        2,
+	}
+}
+
+// GetScoringParams returns the latest params for a member, or the defaults.
+func GetScoringParams(db *gorm.DB, pubkey string) ScoringParams {
+	var params ScoringParams
+	err := db.Where("metadata_pubkey = ?", pubkey).Order("created_at desc").First(&params).Error
+	if err != nil {
+		return DefaultScoringParams(pubkey)
+	}
+	return params
+}
+
+func (p ScoringParams) Validate() error {
+	if _, err := GetScorer(p.Algorithm); err != nil {
+		return err
+	}
+	if p.AttenuationFactor <= 0 || p.AttenuationFactor > 1 {
+		return errors.New("AttenuationFactor must be in (0, 1]")
+	}
+	if p.Rigor <= 0 || p.Rigor >= 1 {
+		return errors.New("Rigor must be in (0, 1)")
+	}
+	unitParams := []struct {
+		name  string
+		value float64
+	}{
+		{"DefaultUserScore", p.DefaultUserScore},
+		{"DefaultUserConfidence", p.DefaultUserConfidence},
+		{"FollowInterpretationScore", p.FollowInterpretationScore},
+		{"FollowInterpretationConfidence", p.FollowInterpretationConfidence},
+		{"MuteInterpretationScore", p.MuteInterpretationScore},
+		{"MuteInterpretationConfidence", p.MuteInterpretationConfidence},
+	}
+	for _, u := range unitParams {
+		if u.value < 0 || u.value > 1 {
+			return errors.New(u.name + " must be in [0, 1]")
+		}
+	}
+	if p.Epsilon < 0 || p.Epsilon >= 1 {
+		return errors.New("Epsilon must be in [0, 1)")
+	}
+	if p.MaxIterations < 1 || p.MaxIterations > 100 {
+		return errors.New("MaxIterations must be between 1 and 100")
+	}
+	if p.Damping <= 0 || p.Damping >= 1 {
+		return errors.New("Damping must be in (0, 1)")
+	}
+	if p.Nip05Factor < 0 || p.Nip05Factor > 1 {
+		return errors.New("Nip05Factor must be in [0, 1]")
+	}
+	if p.MaxHops < 1 || p.MaxHops > 4 {
+		return errors.New("MaxHops must be between 1 and 4")
+	}
+	return nil
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"gorm.io/gorm"
+)
+
+const (
+	relayConnectTimeout = 15 * time.Second
+	reconnectMinBackoff = time.Second
+	reconnectMaxBackoff = 5 * time.Minute
+	// how often the health metrics of the pool are written to RelayStatus
+	relayHealthInterval = 30 * time.Second
+	// a relay is demoted once it sent this many invalid events and they are at
+	// least invalidEventsPercent of what it sent
+	invalidEventsMin     = 10
+	invalidEventsPercent = 5
+)
+
+var (
+	errNotConnected = errors.New("relay is not connected")
+	errOutboxFull   = errors.New("too many outbox relays connected")
+)
+
+// Pool owns every relay connection used for scraping
+var Pool = NewRelayPool()
+
+// RelayPool keeps one connection per relay url shared by all members. When a
+// connection drops it reconnects with exponential backoff and fires the
+// subscriptions again, resuming from their last EOSE. What members ask for is
+// merged into as few subscriptions as possible, see subscriptions.go.
+type RelayPool struct {
+	mu      sync.Mutex
+	relays  map[string]*poolRelay
+	closing bool
+}
+
+type poolRelay struct {
+	url  string
+	mu   sync.Mutex
+	conn *nostr.Relay
+	subs []*poolSub
+	// members that requested anything from this relay
+	members map[string]bool
+
+	// requests waiting for the merge window, and what the subscriptions already cover
+	pending  []*subRequest
+	flushing bool
+	coverage map[int]map[string]coverage
+	// dropped is set when the relay was disabled or closed, it is not reconnected
+	dropped bool
+	// outbox relays are only connected for the outbox model, the pool caps how
+	// many of them are open and closes them when no scrape uses them anymore
+	outbox bool
+	// lastUsed is when a member last requested anything from the relay
+	lastUsed time.Time
+
+	// health metrics, see flushHealth
+	connectedAt time.Time
+	downSince   time.Time
+	uptime      time.Duration
+	downtime    time.Duration
+	latency     time.Duration
+	events      int64
+	invalid     int64
+	// events counted before the last reset of invalid, they don't count towards demotion
+	invalidSince int64
+	demoted      bool
+	lastEvents   int64
+	lastFlush    time.Time
+	errors       int
+	reconnects   int
+}
+
+func NewRelayPool() *RelayPool {
+	return &RelayPool{relays: make(map[string]*poolRelay)}
+}
+
+func (p *RelayPool) get(url string) *poolRelay {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.relays[url]
+}
+
+// Connected reports whether the relay is currently connected
+func (p *RelayPool) Connected(url string) bool {
+	r := p.get(url)
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conn != nil && r.conn.IsConnected()
+}
+
+// Connect opens the relay unless the pool already has it and keeps it open
+// from then on. A relay that can't be reached at all is not kept, the next
+// scrape tries again.
+func (p *RelayPool) Connect(ctx context.Context, url string) error {
+	return p.connect(ctx, url, false)
+}
+
+// ConnectOutbox is Connect for a relay only used through the outbox model. At
+// most OutboxMaxConnections of those are open at once, when that many are the
+// one unused for the longest is closed to make room. Relays a scrape asked
+// something from within the outbox EOSE timeout are never closed for that.
+func (p *RelayPool) ConnectOutbox(ctx context.Context, url string) error {
+	if r := p.get(url); r != nil {
+		r.touch()
+		return nil
+	}
+	if p.outboxCount() >= TheConfig.OutboxMaxConnections {
+		lru := p.leastUsedOutbox(time.Now().Add(-outboxEOSETimeout))
+		if lru == "" {
+			return errOutboxFull
+		}
+		p.close(lru, "connection closed: making room for another outbox relay")
+	}
+	return p.connect(ctx, url, true)
+}
+
+func (p *RelayPool) connect(ctx context.Context, url string, outbox bool) error {
+	if p.get(url) != nil {
+		return nil
+	}
+	conn, latency, err := dialRelay(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	r := &poolRelay{
+		url:       url,
+		members:   make(map[string]bool),
+		coverage:  make(map[int]map[string]coverage),
+		outbox:    outbox,
+		lastUsed:  time.Now(),
+		lastFlush: time.Now(),
+	}
+	r.connected(conn, latency)
+	p.mu.Lock()
+	if _, exists := p.relays[url]; exists || p.closing {
+		// lost a race with another scrape connecting the same relay
+		p.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	if outbox && p.countOutbox() >= TheConfig.OutboxMaxConnections {
+		// another scrape took the room meanwhile
+		p.mu.Unlock()
+		conn.Close()
+		return errOutboxFull
+	}
+	p.relays[url] = r
+	p.mu.Unlock()
+
+	go p.watch(r)
+	return nil
+}
+
+// countOutbox is how many outbox relays the pool has, p.mu must be held
+func (p *RelayPool) countOutbox() int {
+	count := 0
+	for _, r := range p.relays {
+		if r.outbox {
+			count++
+		}
+	}
+	return count
+}
+
+func (p *RelayPool) outboxCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.countOutbox()
+}
+
+// outboxRelays returns the outbox relays of the pool with when they were last used
+func (p *RelayPool) outboxRelays() map[string]time.Time {
+	p.mu.Lock()
+	relays := make([]*poolRelay, 0, len(p.relays))
+	for _, r := range p.relays {
+		if r.outbox {
+			relays = append(relays, r)
+		}
+	}
+	p.mu.Unlock()
+
+	lastUsed := make(map[string]time.Time, len(relays))
+	for _, r := range relays {
+		r.mu.Lock()
+		lastUsed[r.url] = r.lastUsed
+		r.mu.Unlock()
+	}
+	return lastUsed
+}
+
+// leastUsedOutbox is the outbox relay unused for the longest, if it wasn't used after before
+func (p *RelayPool) leastUsedOutbox(before time.Time) string {
+	lru := ""
+	for url, used := range p.outboxRelays() {
+		if used.Before(before) {
+			lru, before = url, used
+		}
+	}
+	return lru
+}
+
+// CloseIdleOutbox closes the outbox relays no member requested anything from within timeout
+func (p *RelayPool) CloseIdleOutbox(timeout time.Duration) {
+	for url, used := range p.outboxRelays() {
+		if time.Since(used) > timeout {
+			p.close(url, "connection closed: idle")
+		}
+	}
+}
+
+func (r *poolRelay) touch() {
+	r.mu.Lock()
+	r.lastUsed = time.Now()
+	r.mu.Unlock()
+}
+
+// CountEvent adds an event received from url to the health metrics
+func (p *RelayPool) CountEvent(url string) {
+	if r := p.get(url); r != nil {
+		r.mu.Lock()
+		r.events++
+		r.mu.Unlock()
+	}
+}
+
+// CountInvalid adds an event with a bad id or signature from url to the health
+// metrics and demotes the relay when too many of its events are invalid
+func (p *RelayPool) CountInvalid(url string) {
+	r := p.get(url)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.invalid++
+	invalid, events := r.invalid, r.events-r.invalidSince
+	demote := !r.demoted && invalid >= invalidEventsMin && invalid*100 >= events*invalidEventsPercent
+	if demote {
+		r.demoted = true
+	}
+	r.mu.Unlock()
+	if demote {
+		demoteRelay(DB, url, fmt.Sprintf("%d of %d events had an invalid id or signature", invalid, events))
+	}
+}
+
+// ResetInvalid forgets the invalid events of a relay so it can be demoted again
+func (p *RelayPool) ResetInvalid(url string) {
+	if r := p.get(url); r != nil {
+		r.mu.Lock()
+		r.invalid = 0
+		r.invalidSince = r.events
+		r.demoted = false
+		r.mu.Unlock()
+	}
+}
+
+// Close closes every connection for good, on shutdown
+func (p *RelayPool) Close() {
+	p.mu.Lock()
+	p.closing = true
+	relays := make([]*poolRelay, 0, len(p.relays))
+	for _, r := range p.relays {
+		relays = append(relays, r)
+	}
+	p.mu.Unlock()
+
+	for _, r := range relays {
+		r.mu.Lock()
+		conn := r.conn
+		r.mu.Unlock()
+		if conn != nil {
+			TheLog.Printf("Closing connection to relay: %s\n", r.url)
+			conn.Close()
+		}
+		UpdateOrCreateRelayStatus(DB, r.url, "connection error: app exit", "")
+	}
+}
+
+// Drop closes a relay for good and forgets its subscriptions, when it gets disabled
+func (p *RelayPool) Drop(url string) {
+	p.close(url, "connection error: relay disabled")
+}
+
+// close closes a relay and forgets its subscriptions, a later Connect opens it again
+func (p *RelayPool) close(url string, status string) {
+	p.mu.Lock()
+	r := p.relays[url]
+	delete(p.relays, url)
+	p.mu.Unlock()
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.dropped = true
+	conn := r.conn
+	r.mu.Unlock()
+	if conn != nil {
+		TheLog.Printf("Closing connection to relay %s: %s\n", url, status)
+		conn.Close()
+	}
+	UpdateOrCreateRelayStatus(DB, url, status, "")
+}
+
+func (r *poolRelay) isDropped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.dropped
+}
+
+func (p *RelayPool) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closing
+}
+
+func dialRelay(ctx context.Context, url string) (*nostr.Relay, time.Duration, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, relayConnectTimeout)
+	defer cancel()
+	start := time.Now()
+	// the connection must outlive the dial timeout, so it is not derived from dialCtx
+	conn := nostr.NewRelay(CTX, url)
+	// processSub checks id and signature itself so invalid events can be counted
+	conn.AssumeValid = true
+	if err := conn.Connect(dialCtx); err != nil {
+		return nil, 0, err
+	}
+	return conn, time.Since(start), nil
+}
+
+// backoff is the wait before reconnect attempt n, doubling up to the max with some jitter
+func backoff(attempt int) time.Duration {
+	wait := reconnectMaxBackoff
+	if attempt < 20 {
+		wait = reconnectMinBackoff << attempt
+	}
+	if wait > reconnectMaxBackoff {
+		wait = reconnectMaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// watch waits for the connection to drop, then reconnects until it succeeds or the pool closes
+func (p *RelayPool) watch(r *poolRelay) {
+	for {
+		r.mu.Lock()
+		conn := r.conn
+		r.mu.Unlock()
+		<-conn.Context().Done()
+		if p.isClosing() || r.isDropped() {
+			return
+		}
+
+		cause := "connection closed"
+		if conn.ConnectionError != nil {
+			cause = conn.ConnectionError.Error()
+		}
+		TheLog.Printf("lost connection to %s: %s, reconnecting", r.url, cause)
+		r.disconnected()
+		UpdateOrCreateRelayStatus(DB, r.url, "connection error: "+cause, "")
+
+		for attempt := 0; ; attempt++ {
+			time.Sleep(backoff(attempt))
+			if p.isClosing() || r.isDropped() {
+				return
+			}
+			newConn, latency, err := dialRelay(CTX, r.url)
+			if err != nil {
+				TheLog.Printf("reconnect %d to %s failed: %s", attempt+1, r.url, err)
+				r.mu.Lock()
+				r.errors++
+				r.mu.Unlock()
+				UpdateOrCreateRelayStatus(DB, r.url, fmt.Sprintf("reconnecting: attempt %d failed", attempt+1), "")
+				continue
+			}
+			if r.isDropped() {
+				newConn.Close()
+				return
+			}
+			r.mu.Lock()
+			r.reconnects++
+			r.mu.Unlock()
+			subs := r.connected(newConn, latency)
+			UpdateOrCreateRelayStatus(DB, r.url, "connection established", "")
+			r.resubscribe(newConn, subs)
+			break
+		}
+	}
+}
+
+// connected switches to a new connection and returns the subscriptions to fire
+// on it, later ones are fired by flush itself
+func (r *poolRelay) connected(conn *nostr.Relay, latency time.Duration) []*poolSub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if !r.downSince.IsZero() {
+		r.downtime += now.Sub(r.downSince)
+		r.downSince = time.Time{}
+	}
+	r.conn = conn
+	r.connectedAt = now
+	r.latency = latency
+	subs := make([]*poolSub, len(r.subs))
+	copy(subs, r.subs)
+	return subs
+}
+
+func (r *poolRelay) disconnected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.uptime += now.Sub(r.connectedAt)
+	r.connectedAt = time.Time{}
+	r.downSince = now
+	r.conn = nil
+	r.errors++
+}
+
+// resubscribe fires the kept subscriptions on a new connection. Subscriptions
+// that got their stored events before only ask for what came after their last EOSE.
+func (r *poolRelay) resubscribe(conn *nostr.Relay, subs []*poolSub) {
+	// members are waiting for EOSE again, waitForEOSE relies on that
+	r.waitForAll(subs)
+
+	for _, ps := range subs {
+		r.mu.Lock()
+		lastEOSE := ps.lastEOSE
+		r.mu.Unlock()
+		filters := ps.filters
+		if !lastEOSE.IsZero() {
+			since := nostr.Timestamp(lastEOSE.Unix())
+			filters = make(nostr.Filters, len(ps.filters))
+			for i, f := range ps.filters {
+				if f.Since == nil || *f.Since < since {
+					f.Since = &since
+				}
+				filters[i] = f
+			}
+		}
+		if err := r.fire(conn, ps, filters); err != nil {
+			TheLog.Printf("error resubscribing on %s: %s", r.url, err)
+		}
+	}
+	TheLog.Printf("resubscribed %d subscriptions on %s", len(subs), r.url)
+}
+
+// startRelayHealth periodically writes the health metrics of the pool to RelayStatus
+func startRelayHealth(db *gorm.DB) {
+	// nothing is connected yet, whatever the last run left behind is stale
+	db.Model(&RelayStatus{}).Where("status like ?", "%established%").Update("status", "not connected: restart")
+
+	go func() {
+		for {
+			time.Sleep(relayHealthInterval)
+			Pool.mu.Lock()
+			relays := make([]*poolRelay, 0, len(Pool.relays))
+			for _, r := range Pool.relays {
+				relays = append(relays, r)
+			}
+			Pool.mu.Unlock()
+			for _, r := range relays {
+				r.flushHealth(db)
+			}
+			if TheConfig.OutboxIdleTimeout > 0 {
+				Pool.CloseIdleOutbox(time.Duration(TheConfig.OutboxIdleTimeout))
+			}
+		}
+	}()
+}
+
+// flushHealth writes uptime, downtime, latency, event rate and error counts of
+// the shared connection to the status of every member using the relay.
+// Health is the share of time the relay was connected.
+func (r *poolRelay) flushHealth(db *gorm.DB) {
+	r.mu.Lock()
+	now := time.Now()
+	uptime := r.uptime
+	if !r.connectedAt.IsZero() {
+		uptime += now.Sub(r.connectedAt)
+	}
+	downtime := r.downtime
+	if !r.downSince.IsZero() {
+		downtime += now.Sub(r.downSince)
+	}
+	rate := float64(r.events-r.lastEvents) / now.Sub(r.lastFlush).Seconds()
+	r.lastEvents = r.events
+	r.lastFlush = now
+	health := 1.0
+	if uptime+downtime > 0 {
+		health = float64(uptime) / float64(uptime+downtime)
+	}
+	values := map[string]interface{}{
+		"connected_at":      r.connectedAt,
+		"uptime_seconds":    int64(uptime.Seconds()),
+		"downtime_seconds":  int64(downtime.Seconds()),
+		"latency_ms":        r.latency.Milliseconds(),
+		"events":            r.events,
+		"invalid_events":    r.invalid,
+		"events_per_second": rate,
+		"errors":            r.errors,
+		"reconnects":        r.reconnects,
+		"health":            health,
+	}
+	if r.connectedAt.IsZero() {
+		values["connected_at"] = time.Unix(0, 0)
+	}
+	r.mu.Unlock()
+
+	db.Model(&RelayStatus{}).Where("url = ?", r.url).Updates(values)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Relay is a relay every member is scraped from unless disabled. Relays with a
+// higher Priority are connected first.
+type Relay struct {
+	Url      string `gorm:"primaryKey;size:512"`
+	Enabled  bool
+	Priority int
+	// Demoted relays sent too many invalid events, saving the relay again clears it
+	Demoted      bool
+	DemoteReason string `gorm:"size:512"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// MemberRelay overrides a relay for one member: Enabled false leaves a global
+// relay out, Enabled true adds a relay or changes its priority
+type MemberRelay struct {
+	MetadataPubkey string `gorm:"primaryKey;size:65"`
+	Url            string `gorm:"primaryKey;size:512"`
+	Enabled        bool
+	Priority       int
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// EffectiveRelay is a relay a member is scraped from and where the setting comes from
+type EffectiveRelay struct {
+	Url      string
+	Priority int
+	// Source is "global" or "member"
+	Source    string
+	Connected bool
+}
+
+func (r *Relay) Validate() error {
+	url := normalizeRelayURL(r.Url)
+	if url == "" {
+		return errors.New("Url must be a websocket relay url")
+	}
+	r.Url = url
+	return nil
+}
+
+func (r *MemberRelay) Validate() error {
+	url := normalizeRelayURL(r.Url)
+	if url == "" {
+		return errors.New("Url must be a websocket relay url")
+	}
+	r.Url = url
+	return nil
+}
+
+// seedRelays fills an empty relay table with the configured relays, the first one gets the highest priority
+func seedRelays(db *gorm.DB, urls []string) error {
+	var count int64
+	db.Model(&Relay{}).Count(&count)
+	if count > 0 {
+		return nil
+	}
+	for i, url := range urls {
+		relay := Relay{Url: url, Enabled: true, Priority: len(urls) - i}
+		if err := relay.Validate(); err != nil {
+			return err
+		}
+		if err := db.Create(&relay).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EffectiveRelays are the relays a member is scraped from by priority, the
+// enabled global relays with the member's overrides applied
+func EffectiveRelays(db *gorm.DB, pubkey string) []EffectiveRelay {
+	var relays []Relay
+	db.Where("enabled = ?", true).Find(&relays)
+	var overrides []MemberRelay
+	db.Where("metadata_pubkey = ?", pubkey).Find(&overrides)
+
+	byUrl := make(map[string]EffectiveRelay)
+	for _, r := range relays {
+		byUrl[r.Url] = EffectiveRelay{Url: r.Url, Priority: r.Priority, Source: "global"}
+	}
+	for _, o := range overrides {
+		if o.Enabled {
+			byUrl[o.Url] = EffectiveRelay{Url: o.Url, Priority: o.Priority, Source: "member"}
+		} else {
+			delete(byUrl, o.Url)
+		}
+	}
+
+	effective := make([]EffectiveRelay, 0, len(byUrl))
+	for _, r := range byUrl {
+		r.Connected = Pool.Connected(r.Url)
+		effective = append(effective, r)
+	}
+	sort.Slice(effective, func(i, j int) bool {
+		if effective[i].Priority != effective[j].Priority {
+			return effective[i].Priority > effective[j].Priority
+		}
+		return effective[i].Url < effective[j].Url
+	})
+	return effective
+}
+
+// scrapeRelayUrls are the urls of the member's effective relays by priority
+func scrapeRelayUrls(db *gorm.DB, pubkey string) []string {
+	var urls []string
+	for _, r := range EffectiveRelays(db, pubkey) {
+		urls = append(urls, r.Url)
+	}
+	return urls
+}
+
+// demoteRelay moves a relay that sends invalid events behind all others. Relays
+// only used through the outbox model are disabled and closed instead.
+func demoteRelay(db *gorm.DB, url string, reason string) {
+	var relay Relay
+	if db.Where("url = ?", url).First(&relay).Error == nil {
+		var lowest int
+		db.Model(&Relay{}).Select("min(priority)").Scan(&lowest)
+		db.Model(&relay).Updates(map[string]interface{}{"priority": lowest - 1, "demoted": true, "demote_reason": reason})
+		TheLog.Printf("demoted relay %s: %s", url, reason)
+		return
+	}
+	db.Create(&Relay{Url: url, Enabled: false, Demoted: true, DemoteReason: reason})
+	Pool.Drop(url)
+	TheLog.Printf("disabled outbox relay %s: %s", url, reason)
+}
+
+// disabledRelays are relays turned off by an admin or a demotion, the outbox model doesn't use them either
+func disabledRelays(db *gorm.DB) map[string]bool {
+	var urls []string
+	db.Model(&Relay{}).Where("enabled = ?", false).Pluck("url", &urls)
+	disabled := make(map[string]bool)
+	for _, url := range urls {
+		disabled[url] = true
+	}
+	return disabled
+}
@@ -4,9 +4,9 @@ import (
 	"context"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
 	"time"
 
@@ -15,8 +15,8 @@ import (
 	"gorm.io/gorm"
 )
 
-var nostrSubs []*nostr.Subscription
-var nostrRelays []*nostr.Relay
+// how long to wait for a relay to finish a hop before subscribing to the next one
+const hopEOSETimeout = 60 * time.Second
 
 func isHex(s string) bool {
 	dst := make([]byte, hex.DecodedLen(len(s)))
@@ -29,20 +29,12 @@ func isHex(s string) bool {
 }
 
 func watchInterrupt() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		TheLog.Println("exiting gracefully")
-		for _, s := range nostrSubs {
-			s.Unsub()
-			s.Close()
-		}
-		for _, r := range nostrRelays {
-			TheLog.Printf("Closing connection to relay: %s\n", r.URL)
-			r.Close()
-			UpdateOrCreateRelayStatus(DB, r.URL, "connection error: app exit", "")
-		}
+		Pool.Close()
 		// give other relays time to close
 		time.Sleep(3 * time.Second)
 		os.Exit(0)
@@ -50,53 +42,22 @@ func watchInterrupt() {
 }
 
 func doRelay(db *gorm.DB, ctx context.Context, url string, pubkey string) bool {
-	// check if connection already established
-	var fr RelayStatus
-	db.Model(fr).Where("url = ? and metadata_pubkey = ?", url, pubkey).First(&fr)
-	if strings.Contains(fr.Status, "established") {
-		return true
-	}
-
-	relay, err := nostr.RelayConnect(ctx, url)
-	if err != nil {
+	// the connection is shared with the other members and kept alive across
+	// reconnects. Scraping again is cheap, the pool only subscribes to authors
+	// its subscriptions don't cover yet, like new follows.
+	if err := Pool.Connect(ctx, url); err != nil {
 		TheLog.Printf("failed initial connection to relay: %s, %s; skipping relay", url, err)
 		UpdateOrCreateRelayStatus(db, url, "failed initial connection", pubkey)
 		return false
 	}
-	nostrRelays = append(nostrRelays, relay)
-
 	UpdateOrCreateRelayStatus(db, url, "connection established", pubkey)
 
 	// what do we need for this pubkey for WoT:
 
-	// the follow list (hop1)
-	// the follow list of each follow (hop2)
-	// hop3?
-
-	hop1Filters := []nostr.Filter{
-		{
-			Kinds:   []int{0},
-			Limit:   1,
-			Authors: []string{pubkey},
-		},
-		{
-			Kinds:   []int{3},
-			Limit:   1,
-			Authors: []string{pubkey},
-		},
-	}
-
-	// create a subscription and submit to relay
-	sub, _ := relay.Subscribe(ctx, hop1Filters)
-	nostrSubs = append(nostrSubs, sub)
-
-	// subscribe to follows for each follow
-	person := Metadata{
-		PubkeyHex: pubkey,
-	}
-
-	var thisHopFollows []Metadata
-	db.Model(&person).Association("Follows").Find(&thisHopFollows)
+	// the relay list, to find the member's graph on their follows' own relays
+	// the follow list and mute list (hop1)
+	// the follow list and mute list of each follow (hop2)
+	// and so on for each hop up to the member's MaxHops
 
 	// Pick up where we left off for this relay based on last EOSE timestamp
 	var rs RelayStatus
@@ -115,218 +76,313 @@ func doRelay(db *gorm.DB, ctx context.Context, url string, pubkey string) bool {
 		since = sinceDisco
 	}
 
-	filterTimestamp := nostr.Timestamp(since.Unix())
-
-	// BATCH filters into chunks of 1000 per filter.
-	var hop2Filters []nostr.Filter
-	counter := 0
-	lastCount := 0
-	if len(thisHopFollows) > 1000 {
-		for i := range thisHopFollows {
-			if i > 0 && i%1000 == 0 {
-				begin := i - 1000
-				end := counter
-				authors := thisHopFollows[begin:end]
-				var authorPubkeys []string
-				for _, a := range authors {
-					authorPubkeys = append(authorPubkeys, a.PubkeyHex)
-				}
+	// request the member's own profile and lists
+	eose := make(chan struct{}, 1)
+	hop1Kinds := []int{0, 3, 10000, KindRelayList}
+	if err := Pool.Request(url, pubkey, hop1Kinds, map[string]nostr.Timestamp{pubkey: 0}, eose); err != nil {
+		TheLog.Printf("error subscribing to %s: %s", url, err)
+	}
 
-				hop2Filters = append(hop2Filters, nostr.Filter{
-					Kinds:   []int{3, 0},
-					Limit:   1000,
-					Authors: authorPubkeys,
-					Since:   &filterTimestamp,
-				})
-				TheLog.Printf("adding chunk subscription for %d:%d", begin, end)
-				lastCount = counter
-			}
-			counter += 1
-		}
-		// leftover
-		if lastCount != counter+1 {
-			begin := lastCount + 1
-			end := len(thisHopFollows) - 1
-			remainingAuthors := thisHopFollows[begin:end]
-			var authorPubkeys []string
-			for _, a := range remainingAuthors {
-				authorPubkeys = append(authorPubkeys, a.PubkeyHex)
-			}
+	params := GetScoringParams(db, pubkey)
+	maxSize := DefaultMaxGraphSize
+	if membership, err := GetMembership(db, pubkey); err == nil {
+		maxSize = membership.MaxGraphSize
+	}
+	go scrapeHops(db, url, pubkey, params.MaxHops, maxSize, nostr.Timestamp(since.Unix()), eose)
 
-			TheLog.Printf("adding leftover chunk subscription for %d:%d", lastCount, end)
+	return Pool.Connected(url)
+}
 
-			hop2Filters = append(hop2Filters, nostr.Filter{
-				Kinds:   []int{3, 0},
-				Limit:   1000,
-				Authors: authorPubkeys,
-				Since:   &filterTimestamp,
-			})
+// scrapeHops subscribes to the lists of the pubkeys one hop further out each
+// time the relay finished sending the previous hop, until maxHops is covered
+func scrapeHops(db *gorm.DB, url string, pubkey string, maxHops int, maxSize int, since nostr.Timestamp, eose chan struct{}) {
+	for hop := 1; hop < maxHops; hop++ {
+		select {
+		case <-eose:
+		case <-time.After(hopEOSETimeout):
+			TheLog.Printf("no EOSE for hop %d from %s after %s, continuing", hop, url, hopEOSETimeout)
 		}
-	} else {
-		var authorPubkeys []string
-		for _, a := range thisHopFollows {
-			authorPubkeys = append(authorPubkeys, a.PubkeyHex)
-		}
-		hop2Filters = append(hop2Filters, nostr.Filter{
-			Kinds:   []int{3, 0},
-			Limit:   1000,
-			Authors: authorPubkeys,
-			Since:   &filterTimestamp,
-		})
-	}
 
-	hop2Sub, _ := relay.Subscribe(ctx, hop2Filters)
-	nostrSubs = append(nostrSubs, hop2Sub)
+		levels := HopLevels(db, pubkey, hop, maxSize)
+		if len(levels) < hop || len(levels[hop-1]) == 0 {
+			TheLog.Printf("no pubkeys at hop %d for %s, done scraping %s", hop, pubkey, url)
+			return
+		}
+		authors := levels[hop-1]
 
-	go func() {
-		processSub(sub, relay, pubkey)
-	}()
+		// profiles only for the member's follows, deeper hops just need their lists
+		kinds := []int{3, 10000, KindRelayList}
+		if hop == 1 {
+			kinds = []int{3, 0, 10000, KindRelayList}
+		}
+		TheLog.Printf("requesting %d authors at hop %d for %s on %s", len(authors), hop+1, pubkey, url)
+		UpdateOrCreateRelayStatus(db, url, fmt.Sprintf("connection established: hop %d", hop+1), pubkey)
 
-	go func() {
-		processSub(hop2Sub, relay, pubkey)
-	}()
+		eose = make(chan struct{}, 1)
+		if err := Pool.Request(url, pubkey, kinds, authorSince(db, authors, since), eose); err != nil {
+			TheLog.Printf("error subscribing to hop %d on %s: %s", hop+1, url, err)
+		}
+	}
+}
 
-	return true
+// authorSince is the since to request each author with. Authors whose contact
+// list we already have only need what changed since the last EOSE, newly
+// discovered ones get their whole history.
+func authorSince(db *gorm.DB, authors []string, since nostr.Timestamp) map[string]nostr.Timestamp {
+	result := make(map[string]nostr.Timestamp, len(authors))
+	for _, a := range authors {
+		result[a] = 0
+	}
+	for begin := 0; begin < len(authors); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > len(authors) {
+			end = len(authors)
+		}
+		var knownChunk []string
+		db.Model(&Metadata{}).Where("pubkey_hex in ? and contacts_updated_at > ?", authors[begin:end], time.Unix(0, 0)).Pluck("pubkey_hex", &knownChunk)
+		for _, k := range knownChunk {
+			result[k] = since
+		}
+	}
+	return result
 }
 
-func processSub(sub *nostr.Subscription, relay *nostr.Relay, pubkey string) {
+// processSub stores the events of a subscription, onEOSE (may be nil) is
+// called once the relay sent all stored events and onClosed (may be nil) once
+// the subscription ended. Subscriptions are shared by members, what they are
+// waiting for is tracked by the pool.
+func processSub(sub *nostr.Subscription, relay *nostr.Relay, onEOSE func(), onClosed func()) {
 
 	go func() {
-		<-sub.EndOfStoredEvents
-		TheLog.Printf("got EOSE from %s\n", relay.URL)
-		UpdateOrCreateRelayStatus(DB, relay.URL, "connection established: EOSE", pubkey)
+		eose := sub.EndOfStoredEvents
+		for {
+			select {
+			case <-eose:
+				TheLog.Printf("got EOSE from %s\n", relay.URL)
+				if onEOSE != nil {
+					onEOSE()
+				}
+				eose = nil
+			case reason := <-sub.ClosedReason:
+				// the subscription stays open on our side until unsubscribed,
+				// which ends the events loop below
+				TheLog.Printf("%s closed a subscription: %s", relay.URL, reason)
+				sub.Unsub()
+				return
+			case <-sub.Context.Done():
+				return
+			}
+		}
 	}()
 
 	if sub != nil {
 		for ev := range sub.Events {
+			Pool.CountEvent(relay.URL)
+			// relays can send anything, only store what the author really signed
+			if err := checkEvent(ev); err != nil {
+				TheLog.Printf("dropping invalid event %s from %s: %s", ev.ID, relay.URL, err)
+				Pool.CountInvalid(relay.URL)
+				continue
+			}
 			TheLog.Printf("got event kind %d from relay %s", ev.Kind, relay.URL)
-			if ev.Kind == 0 {
-				// Metadata
-				m := Metadata{}
-				err := json.Unmarshal([]byte(ev.Content), &m)
-				unmarshalSuccess := false
-				if err != nil {
-					TheLog.Printf("%s: %v", err, ev.Content)
-					m.RawJsonContent = ev.Content
-				} else {
-					unmarshalSuccess = true
-				}
-				m.PubkeyHex = ev.PubKey
-				npub, errEncode := nip19.EncodePublicKey(ev.PubKey)
-				if errEncode == nil {
-					m.PubkeyNpub = npub
-				}
-				m.MetadataUpdatedAt = ev.CreatedAt.Time()
-				m.ContactsUpdatedAt = time.Unix(0, 0)
-				if len(m.Picture) > 65535 {
-					//TheLog.Println("too big a picture for profile, skipping" + ev.PubKey)
-					m.Picture = ""
-					//continue
-				}
-				// check timestamps
-				var checkMeta Metadata
-				notFoundErr := DB.First(&checkMeta, "pubkey_hex = ?", m.PubkeyHex).Error
-				if notFoundErr != nil {
-					err := DB.Save(&m).Error
-					if err != nil {
-						TheLog.Printf("Error saving metadata was: %s", err)
-					}
-					TheLog.Printf("Created metadata for %s, %s\n", m.Name, m.Nip05)
-				} else {
-					if checkMeta.MetadataUpdatedAt.After(ev.CreatedAt.Time()) || checkMeta.MetadataUpdatedAt.Equal(ev.CreatedAt.Time()) {
-						TheLog.Println("skipping old metadata for " + ev.PubKey)
-						continue
-					} else {
-						rowsUpdated := DB.Model(Metadata{}).Where("pubkey_hex = ?", m.PubkeyHex).Updates(&m).RowsAffected
-						if rowsUpdated > 0 {
-							TheLog.Printf("Updated metadata for %s, %s\n", m.Name, m.Nip05)
-						} else {
-							//
-							// here we need go store the record anyway, with a pubkey, and the 'rawjson'
-							TheLog.Printf("UNCOOL NESTED JSON FOR METADATA DETECTED, falling back to RAW json %v, unmarshalsuccess was: %v", m, unmarshalSuccess)
-						}
-					}
+			archiveEvent(DB, ev, relay.URL)
+			notifyGraphChange(applyEvent(ev))
+		}
+	}
+	if onClosed != nil {
+		onClosed()
+	}
+}
+
+// applyEvent stores a profile, follow list, mute list or relay list unless a
+// newer one is known already and returns what changed in the graph
+func applyEvent(ev *nostr.Event) GraphChange {
+	if ev.Kind == 0 {
+		// Metadata
+		m := Metadata{}
+		err := json.Unmarshal([]byte(ev.Content), &m)
+		unmarshalSuccess := false
+		if err != nil {
+			TheLog.Printf("%s: %v", err, ev.Content)
+			m.RawJsonContent = rawJson(ev.Content)
+		} else {
+			unmarshalSuccess = true
+		}
+		m.PubkeyHex = ev.PubKey
+		npub, errEncode := nip19.EncodePublicKey(ev.PubKey)
+		if errEncode == nil {
+			m.PubkeyNpub = npub
+		}
+		m.MetadataUpdatedAt = ev.CreatedAt.Time()
+		if len(m.Picture) > 65535 {
+			//TheLog.Println("too big a picture for profile, skipping" + ev.PubKey)
+			m.Picture = ""
+			//return GraphChange{}
+		}
+		// check timestamps
+		var checkMeta Metadata
+		notFoundErr := DB.First(&checkMeta, "pubkey_hex = ?", m.PubkeyHex).Error
+		if notFoundErr != nil {
+			// no lists seen yet, an update leaves their timestamps alone
+			m.ContactsUpdatedAt = time.Unix(0, 0)
+			m.MutesUpdatedAt = time.Unix(0, 0)
+			err := DB.Save(&m).Error
+			if err != nil {
+				TheLog.Printf("Error saving metadata was: %s", err)
+			}
+			TheLog.Printf("Created metadata for %s, %s\n", m.Name, m.Nip05)
+		} else {
+			if checkMeta.MetadataUpdatedAt.After(ev.CreatedAt.Time()) || checkMeta.MetadataUpdatedAt.Equal(ev.CreatedAt.Time()) {
+				TheLog.Println("skipping old metadata for " + ev.PubKey)
+				return GraphChange{}
+			} else {
+				if m.Nip05 != checkMeta.Nip05 {
+					// a new identifier is checked from scratch
+					DB.Model(Metadata{}).Where("pubkey_hex = ?", m.PubkeyHex).Omit("updated_at").Updates(map[string]interface{}{"nip05_status": "", "nip05_domain": "", "nip05_checked_at": time.Unix(0, 0)})
 				}
-			} else if ev.Kind == 3 {
-
-				// Contact List
-				pTags := []string{"p"}
-				allPTags := ev.Tags.GetAll(pTags)
-				var person Metadata
-				notFoundError := DB.First(&person, "pubkey_hex = ?", ev.PubKey).Error
-				if notFoundError != nil {
-					//TheLog.Printf("Creating blank metadata for %s\n", ev.PubKey)
-					person = Metadata{
-						PubkeyHex:    ev.PubKey,
-						TotalFollows: len(allPTags),
-						// set time to january 1st 1970
-						MetadataUpdatedAt: time.Unix(0, 0),
-						ContactsUpdatedAt: ev.CreatedAt.Time(),
-					}
-					DB.Create(&person)
+				rowsUpdated := DB.Model(Metadata{}).Where("pubkey_hex = ?", m.PubkeyHex).Updates(&m).RowsAffected
+				if rowsUpdated > 0 {
+					TheLog.Printf("Updated metadata for %s, %s\n", m.Name, m.Nip05)
 				} else {
-					if person.ContactsUpdatedAt.After(ev.CreatedAt.Time()) {
-						// double check the timestamp for this follow list, don't update if older than most recent
-						TheLog.Printf("skipping old contact list for " + ev.PubKey)
-						continue
-					} else {
-						DB.Model(&person).Omit("updated_at").Update("total_follows", len(allPTags))
-						DB.Model(&person).Omit("updated_at").Update("contacts_updated_at", ev.CreatedAt.Time())
-						//TheLog.Printf("updating (%d) follows for %s: %s\n", len(allPTags), person.Name, person.PubkeyHex)
-					}
+					//
+					// here we need go store the record anyway, with a pubkey, and the 'rawjson'
+					TheLog.Printf("UNCOOL NESTED JSON FOR METADATA DETECTED, falling back to RAW json %v, unmarshalsuccess was: %v", m, unmarshalSuccess)
 				}
+			}
+		}
+	} else if ev.Kind == 3 {
+
+		// Contact List
+		pTags := []string{"p"}
+		allPTags := ev.Tags.GetAll(pTags)
+		var person Metadata
+		notFoundError := DB.First(&person, "pubkey_hex = ?", ev.PubKey).Error
+		if notFoundError != nil {
+			//TheLog.Printf("Creating blank metadata for %s\n", ev.PubKey)
+			person = Metadata{
+				PubkeyHex:    ev.PubKey,
+				TotalFollows: len(allPTags),
+				// set time to january 1st 1970
+				MetadataUpdatedAt: time.Unix(0, 0),
+				ContactsUpdatedAt: ev.CreatedAt.Time(),
+				MutesUpdatedAt:    time.Unix(0, 0),
+			}
+			DB.Create(&person)
+		} else {
+			if person.ContactsUpdatedAt.After(ev.CreatedAt.Time()) {
+				// double check the timestamp for this follow list, don't update if older than most recent
+				TheLog.Printf("skipping old contact list for " + ev.PubKey)
+				return GraphChange{}
+			} else {
+				DB.Model(&person).Omit("updated_at").Update("total_follows", len(allPTags))
+				DB.Model(&person).Omit("updated_at").Update("contacts_updated_at", ev.CreatedAt.Time())
+				//TheLog.Printf("updating (%d) follows for %s: %s\n", len(allPTags), person.Name, person.PubkeyHex)
+			}
+		}
 
-				// purge followers that have been 'unfollowed'
-				var oldFollows []Metadata
-				DB.Model(&person).Association("Follows").Find(&oldFollows)
-				for _, oldFollow := range oldFollows {
-					found := false
-					for _, n := range allPTags {
-						if len(n) >= 2 && n[1] == oldFollow.PubkeyHex {
-							found = true
-						}
-					}
-					if !found {
-						DB.Exec("delete from metadata_follows where metadata_pubkey_hex = ? and follow_pubkey_hex = ?", person.PubkeyHex, oldFollow.PubkeyHex)
-					}
-				}
+		added, removed := updatePubkeyList(person, "Follows", "metadata_follows", "follow_pubkey_hex", allPTags)
+		return GraphChange{Pubkey: person.PubkeyHex, Table: "metadata_follows", Added: added, Removed: removed}
+	} else if ev.Kind == 10000 {
+
+		// Mute List (only the public p tags, encrypted content is private to the author)
+		pTags := []string{"p"}
+		allPTags := ev.Tags.GetAll(pTags)
+		var person Metadata
+		notFoundError := DB.First(&person, "pubkey_hex = ?", ev.PubKey).Error
+		if notFoundError != nil {
+			person = Metadata{
+				PubkeyHex:  ev.PubKey,
+				TotalMutes: len(allPTags),
+				// set time to january 1st 1970
+				MetadataUpdatedAt: time.Unix(0, 0),
+				ContactsUpdatedAt: time.Unix(0, 0),
+				MutesUpdatedAt:    ev.CreatedAt.Time(),
+			}
+			DB.Create(&person)
+		} else {
+			if person.MutesUpdatedAt.After(ev.CreatedAt.Time()) {
+				// same as contact lists, don't update if older than most recent
+				TheLog.Printf("skipping old mute list for " + ev.PubKey)
+				return GraphChange{}
+			} else {
+				DB.Model(&person).Omit("updated_at").Update("total_mutes", len(allPTags))
+				DB.Model(&person).Omit("updated_at").Update("mutes_updated_at", ev.CreatedAt.Time())
+			}
+		}
 
-				for _, c := range allPTags {
-					// if the pubkey fails the sanitization (is a hex value) skip it
-
-					if len(c) < 2 || !isHex(c[1]) {
-						TheLog.Printf("skipping invalid pubkey from follow list: %d, %s ", len(c), c[1])
-						continue
-					}
-					var followPerson Metadata
-					notFoundFollow := DB.First(&followPerson, "pubkey_hex = ?", c[1]).Error
-
-					if notFoundFollow != nil {
-						// follow user not found, need to create it
-						var newUser Metadata
-						// follow user recommend server suggestion if it exists
-						if len(c) >= 3 && c[2] != "" {
-							newUser = Metadata{
-								PubkeyHex:         c[1],
-								ContactsUpdatedAt: time.Unix(0, 0),
-								MetadataUpdatedAt: time.Unix(0, 0),
-							}
-						} else {
-							newUser = Metadata{PubkeyHex: c[1], ContactsUpdatedAt: time.Unix(0, 0), MetadataUpdatedAt: time.Unix(0, 0)}
-						}
-						createNewErr := DB.Omit("Follows").Create(&newUser).Error
-						if createNewErr != nil {
-							TheLog.Println("Error creating user for follow: ", createNewErr)
-						}
-						// use gorm insert statement to update the join table
-						DB.Exec("insert ignore into metadata_follows (metadata_pubkey_hex, follow_pubkey_hex) values (?, ?)", person.PubkeyHex, newUser.PubkeyHex)
-					} else {
-						// use gorm insert statement to update the join table
-						DB.Exec("insert ignore into metadata_follows (metadata_pubkey_hex, follow_pubkey_hex) values (?, ?)", person.PubkeyHex, followPerson.PubkeyHex)
-					}
-				}
+		added, removed := updatePubkeyList(person, "Mutes", "metadata_mutes", "mute_pubkey_hex", allPTags)
+		return GraphChange{Pubkey: person.PubkeyHex, Table: "metadata_mutes", Added: added, Removed: removed}
+	} else if ev.Kind == KindRelayList {
+
+		// Relay List (NIP-65), tells the scraper where an author publishes
+		saveRelayList(DB, ev)
+	}
+	return GraphChange{}
+}
+
+// updatePubkeyList syncs a self referencing join table (metadata_follows or
+// metadata_mutes) for person with the p tags of their latest list event.
+// pubkeys no longer in the list are purged, new ones are inserted and get
+// a blank Metadata row if we have never seen them before. It returns the
+// pubkeys that were added and removed.
+func updatePubkeyList(person Metadata, association string, table string, column string, allPTags nostr.Tags) (added []string, removed []string) {
+	inList := make(map[string]bool)
+	for _, c := range allPTags {
+		if len(c) >= 2 {
+			inList[c[1]] = true
+		}
+	}
+
+	// purge pubkeys that have been removed from the list
+	var oldEntries []Metadata
+	DB.Model(&person).Association(association).Find(&oldEntries)
+	existing := make(map[string]bool)
+	for _, oldEntry := range oldEntries {
+		existing[oldEntry.PubkeyHex] = true
+		if !inList[oldEntry.PubkeyHex] {
+			DB.Exec("delete from "+table+" where metadata_pubkey_hex = ? and "+column+" = ?", person.PubkeyHex, oldEntry.PubkeyHex)
+			removed = append(removed, oldEntry.PubkeyHex)
+		}
+	}
+
+	for _, c := range allPTags {
+		// if the pubkey fails the sanitization (is a hex value) skip it
+		if len(c) < 2 || !isHex(c[1]) {
+			TheLog.Printf("skipping invalid pubkey from %s list: %v", table, c)
+			continue
+		}
+		if existing[c[1]] {
+			continue
+		}
+		existing[c[1]] = true
+
+		var listPerson Metadata
+		notFoundListPerson := DB.First(&listPerson, "pubkey_hex = ?", c[1]).Error
+
+		if notFoundListPerson != nil {
+			// list user not found, need to create it
+			newUser := Metadata{
+				PubkeyHex:         c[1],
+				ContactsUpdatedAt: time.Unix(0, 0),
+				MetadataUpdatedAt: time.Unix(0, 0),
+				MutesUpdatedAt:    time.Unix(0, 0),
+			}
+			createNewErr := DB.Omit("Follows", "Mutes").Create(&newUser).Error
+			if createNewErr != nil {
+				TheLog.Println("Error creating user for "+table+": ", createNewErr)
 			}
 		}
+		insertErr := insertJoinRow(DB, table, column, person.PubkeyHex, c[1])
+		if insertErr != nil {
+			TheLog.Printf("Error inserting into %s: %s", table, insertErr)
+			continue
+		}
+		added = append(added, c[1])
 	}
 
+	if len(added) > 0 || len(removed) > 0 {
+		// lets the scheduler tell whether a member's graph changed since the last calculation
+		DB.Model(&person).Omit("updated_at").Update("graph_updated_at", time.Now())
+	}
+	return added, removed
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultScheduleInterval = 24 * 60 // minutes
+	MinScheduleInterval     = 5       // minutes
+
+	JobRefresh = "refresh"
+
+	// how long a refresh waits for the relays to send their stored events
+	refreshEOSETimeout = 2 * time.Minute
+	schedulerTick      = time.Minute
+)
+
+// Schedule periodically rescrapes and recalculates a member
+type Schedule struct {
+	MetadataPubkey  string `gorm:"primaryKey;size:65"`
+	Enabled         bool
+	IntervalMinutes int
+	NextRunAt       time.Time `gorm:"default:1970-01-01 00:00:00;index"`
+	LastRunAt       time.Time `gorm:"default:1970-01-01 00:00:00"`
+	// LastResult says what the last refresh did, eg. calculated or skipped
+	LastResult string `gorm:"size:512"`
+	UpdatedAt  time.Time
+}
+
+func DefaultSchedule(pubkey string) Schedule {
+	return Schedule{
+		MetadataPubkey:  pubkey,
+		Enabled:         false,
+		IntervalMinutes: DefaultScheduleInterval,
+		NextRunAt:       time.Now(),
+	}
+}
+
+// GetSchedule returns the stored schedule for a member, or a disabled default
+func GetSchedule(db *gorm.DB, pubkey string) Schedule {
+	schedule := DefaultSchedule(pubkey)
+	db.Where("metadata_pubkey = ?", pubkey).First(&schedule)
+	return schedule
+}
+
+func (s Schedule) Validate(membership Membership) error {
+	if s.IntervalMinutes < MinScheduleInterval {
+		return fmt.Errorf("IntervalMinutes must be at least %d", MinScheduleInterval)
+	}
+	if s.IntervalMinutes < membership.MinCalculateInterval {
+		return errors.New("IntervalMinutes must not be shorter than the member's MinCalculateInterval")
+	}
+	return nil
+}
+
+// startScheduler enqueues refresh jobs for due schedules every minute
+func startScheduler(db *gorm.DB) {
+	go func() {
+		for {
+			runDueSchedules(db)
+			time.Sleep(schedulerTick)
+		}
+	}()
+}
+
+func runDueSchedules(db *gorm.DB) {
+	var due []Schedule
+	db.Where("enabled = ? and next_run_at <= ?", true, time.Now()).Find(&due)
+	for _, s := range due {
+		next := time.Now().Add(time.Duration(s.IntervalMinutes) * time.Minute)
+		if _, err := GetMembership(db, s.MetadataPubkey); err != nil {
+			db.Model(&s).Updates(map[string]interface{}{"next_run_at": next, "last_result": "skipped: not a member"})
+			continue
+		}
+		if _, err := Jobs.Enqueue(JobRefresh, s.MetadataPubkey); err != nil {
+			TheLog.Printf("could not enqueue scheduled refresh for %s: %s", s.MetadataPubkey, err)
+			continue
+		}
+		db.Model(&s).Updates(map[string]interface{}{"next_run_at": next, "last_run_at": time.Now()})
+	}
+}
+
+// waitForEOSE waits until every relay we connected to for the member sent EOSE
+func waitForEOSE(db *gorm.DB, pubkey string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		var statuses []RelayStatus
+		db.Where("metadata_pubkey = ?", pubkey).Find(&statuses)
+		waiting := false
+		for _, rs := range statuses {
+			if strings.Contains(rs.Status, "established") && !strings.HasSuffix(rs.Status, "EOSE") {
+				waiting = true
+			}
+		}
+		if !waiting {
+			return
+		}
+		time.Sleep(5 * time.Second)
+	}
+	TheLog.Printf("timed out waiting for EOSE for %s", pubkey)
+}
+
+// graphChangedSince reports whether the member or anyone within maxHops of
+// them changed their follows or mutes after t, every one of those lists can
+// move the member's scores
+func graphChangedSince(db *gorm.DB, pubkey string, maxHops int, maxSize int, t time.Time) bool {
+	pubkeys := []string{pubkey}
+	for _, level := range HopLevels(db, pubkey, maxHops, maxSize) {
+		pubkeys = append(pubkeys, level...)
+	}
+	for begin := 0; begin < len(pubkeys); begin += graphChunkSize {
+		end := begin + graphChunkSize
+		if end > len(pubkeys) {
+			end = len(pubkeys)
+		}
+		var count int64
+		db.Model(&Metadata{}).Where("graph_updated_at > ? and pubkey_hex in ?", t, pubkeys[begin:end]).Count(&count)
+		if count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runRefreshJob scrapes a member, then recalculates unless nothing relevant changed
+func runRefreshJob(job Job, progress func(int)) error {
+	pubkey := job.MetadataPubkey
+	setResult := func(result string) {
+		DB.Model(&Schedule{}).Where("metadata_pubkey = ?", pubkey).Update("last_result", result)
+	}
+
+	err := runScrapeJob(job, func(p int) { progress(p / 3) })
+	if err != nil {
+		setResult("failed: " + err.Error())
+		return err
+	}
+	waitForEOSE(DB, pubkey, refreshEOSETimeout)
+	progress(50)
+
+	var last CalculationRun
+	if DB.Where("metadata_pubkey = ?", pubkey).Order("started_at desc").First(&last).Error == nil {
+		params := GetScoringParams(DB, pubkey)
+		membership, err := GetMembership(DB, pubkey)
+		if err != nil {
+			setResult("failed: " + err.Error())
+			return err
+		}
+		if !graphChangedSince(DB, pubkey, params.MaxHops, membership.MaxGraphSize, last.StartedAt) {
+			TheLog.Printf("no contact list changes for %s since %s, skipping calculation", pubkey, last.StartedAt)
+			setResult("skipped: no changes")
+			return nil
+		}
+	}
+
+	err = calculateWot(pubkey, "", func(p int) { progress(50 + p/2) })
+	if err != nil {
+		setResult("failed: " + err.Error())
+		return err
+	}
+	setResult("calculated")
+	return nil
+}
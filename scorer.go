@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	AlgorithmGrapeRank = "graperank"
+	AlgorithmFollows   = "follows"
+	AlgorithmPageRank  = "pagerank"
+)
+
+// Scorer is a scoring algorithm. It scores the pubkeys of a graph as seen from
+// the seed, the member the graph was loaded for. progress is called with a
+// percentage of the scoring as it goes and is never nil.
+type Scorer interface {
+	Score(graph *Graph, seed int, params ScoringParams, progress func(percent int)) ScoreResult
+}
+
+// PubkeyScore is the score of one pubkey. Score is in 0..1 for every algorithm,
+// the other fields are what the algorithm based it on and zero when it has no such thing.
+type PubkeyScore struct {
+	Score float64
+	// Average is the weighted average of all ratings (GrapeRank)
+	Average float64
+	// Input is the amount of evidence, the sum of rating weights (GrapeRank)
+	// or the number of the seed's follows following the pubkey (follows)
+	Input float64
+	// Certainty is Input converted to 0..1 (GrapeRank)
+	Certainty float64
+}
+
+// ScoreResult is what a Scorer found, Scores by graph id. Pubkeys the
+// algorithm doesn't score are left out.
+type ScoreResult struct {
+	Scores     map[int]PubkeyScore
+	Iterations int
+	Converged  bool
+	// Deltas is how much the scores changed in each iteration
+	Deltas []float64
+}
+
+// Scorers are the algorithms members and requests can pick by name
+var Scorers = map[string]Scorer{
+	AlgorithmGrapeRank: grapeRankScorer{},
+	AlgorithmFollows:   followsScorer{},
+	AlgorithmPageRank:  pageRankScorer{},
+}
+
+// GetScorer returns the scorer for an algorithm name
+func GetScorer(algorithm string) (Scorer, error) {
+	scorer, ok := Scorers[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q, use one of %s", algorithm, strings.Join(algorithmNames(), ", "))
+	}
+	return scorer, nil
+}
+
+func algorithmNames() []string {
+	names := make([]string, 0, len(Scorers))
+	for name := range Scorers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// grapeRankScorer cycles GrapeRank over the hops until the influence scores stop moving
+type grapeRankScorer struct{}
+
+func (grapeRankScorer) Score(graph *Graph, seed int, params ScoringParams, progress func(percent int)) ScoreResult {
+	var result ScoreResult
+	state := newGrapeRankState(graph, seed, params)
+
+	// cycle scores until they stop moving
+	for i := 0; i < params.MaxIterations; i++ {
+		maxDelta := 0.0
+		for _, pkRatee := range graph.Hops {
+			if delta := state.update(pkRatee); delta > maxDelta {
+				maxDelta = delta
+			}
+		}
+		result.Deltas = append(result.Deltas, maxDelta)
+		result.Iterations = i + 1
+		progress(100 * result.Iterations / params.MaxIterations)
+		TheLog.Printf("calculated influence cycle %d, max delta %f\n", i, maxDelta)
+		if maxDelta < params.Epsilon {
+			result.Converged = true
+			break
+		}
+	}
+
+	result.Scores = make(map[int]PubkeyScore)
+	for p, s := range state.inf {
+		if state.scored[p] {
+			result.Scores[p] = PubkeyScore{Score: s, Average: state.avg[p], Input: state.input[p], Certainty: state.certainty[p]}
+		}
+	}
+	return result
+}
+
+// followsScorer scores a pubkey by how many of the seed's follows follow it,
+// as a share of the seed's follows. This is the original WotScore.
+type followsScorer struct{}
+
+func (followsScorer) Score(graph *Graph, seed int, params ScoringParams, progress func(percent int)) ScoreResult {
+	isFollow := make([]bool, graph.Len())
+	for _, f := range graph.Follows {
+		isFollow[f] = true
+	}
+
+	result := ScoreResult{Scores: make(map[int]PubkeyScore), Iterations: 1, Converged: true}
+	for _, pk := range append([]int{seed}, graph.Hops...) {
+		intersection := 0
+		for _, follower := range graph.Followers(pk) {
+			if isFollow[follower] {
+				intersection++
+			}
+		}
+		score := 0.0
+		if len(graph.Follows) > 0 {
+			score = float64(intersection) / float64(len(graph.Follows))
+		}
+		result.Scores[pk] = PubkeyScore{Score: score, Input: float64(intersection)}
+	}
+	progress(100)
+	return result
+}
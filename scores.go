@@ -1,10 +1,74 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"math"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
-func calculateWot(pubkey string) {
+// CalculationRun records how a calculateWot run went, so we can tell
+// whether scores converged and how long it took.
+type CalculationRun struct {
+	ID              uuid.UUID `gorm:"type:char(36);primary_key"`
+	MetadataPubkey  string    `gorm:"size:65;index"`
+	ScoringParamsID uuid.UUID `gorm:"type:char(36)"`
+	// Algorithm is the Scorer that produced the GvScores
+	Algorithm  string `gorm:"size:32;default:graperank"`
+	GraphSize  int
+	Iterations int
+	Converged  bool
+	// Deltas is how much the scores changed in each iteration
+	Deltas []float64 `gorm:"serializer:json;type:text"`
+	// Incremental runs only rescore pubkeys downstream of changed lists,
+	// Updates counts how many pubkeys they rescored
+	Incremental bool
+	Updates     int
+	// Truncated runs hit the member's MaxGraphSize before walking all hops
+	Truncated bool
+	// InputHash is a sha256 of the graph, the params and the algorithm of a full
+	// run, OutputHash of the scores it produced. Runs with the same InputHash
+	// have the same OutputHash. Both are empty for incremental runs.
+	InputHash  string `gorm:"size:64;index"`
+	OutputHash string `gorm:"size:64"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+	DurationMs int64
+}
+
+func (m *CalculationRun) BeforeCreate(tx *gorm.DB) error {
+	m.ID = uuid.New()
+	return nil
+}
+
+// calculateWot computes and stores the GvScores of a member with an algorithm,
+// the member's own when empty, and the WotScores.
+// progress is called with a percentage as the calculation goes, it may be nil.
+// Only members can be calculated and their graph must fit in their quota.
+func calculateWot(pubkey string, algorithm string, progress func(percent int)) error {
+	if progress == nil {
+		progress = func(int) {}
+	}
+	membership, err := GetMembership(DB, pubkey)
+	if err != nil {
+		return err
+	}
+	params := GetScoringParams(DB, pubkey)
+	if algorithm == "" {
+		algorithm = params.Algorithm
+	}
+	scorer, err := GetScorer(algorithm)
+	if err != nil {
+		return err
+	}
+	run := CalculationRun{MetadataPubkey: pubkey, Algorithm: algorithm, StartedAt: time.Now()}
+
 	var followersCount int64
 	var followsCount int64
 	DB.Table("metadata_follows").Where("follow_pubkey_hex = ?", pubkey).Count(&followersCount)
@@ -12,206 +76,259 @@ func calculateWot(pubkey string) {
 
 	var person Metadata
 	DB.FirstOrInit(&person, Metadata{PubkeyHex: pubkey})
-	var follows []Metadata
-	assocError := DB.Model(&person).Association("Follows").Find(&follows)
-	if assocError == nil {
-		allHop := make(map[string]Metadata)
-		for _, f := range follows {
-			fperson := Metadata{PubkeyHex: f.PubkeyHex}
-			var hop1follows []Metadata
-			assocErrorHop1 := DB.Model(&fperson).Association("Follows").Find(&hop1follows)
-			if assocErrorHop1 == nil {
-				//TheLog.Printf("WEORE DOING STUFF hop1follows %v", len(hop1follows))
-				for _, h1f := range hop1follows {
-					allHop[h1f.PubkeyHex] = h1f
-				}
-			} else {
-				//error
-			}
 
-		}
-		TheLog.Printf("hop1 follows for %s was: %d", pubkey, len(allHop))
-
-		// Influence score notes::
-		// iterate over allHop, and create the scores!
-		//dunbarNumber := 100.0
-		attenuationFactor := 80.0 / 100.0
-		rigor := 25.0 / 100.0
-		defaultUserScore := 0.00     // / 100
-		defaultUserConfidence := 0.0 // / 100
-		followInterpretationScore := 100.0 / 100.0
-		followInterpretationConfidence := 5.0 / 100.0
-
-		//			muteInterpretationScore := 0.0 / 100
-		//			muteInterpretationConfidence := 10.0 / 100
-
-		infScores := make(map[string]float64)
-		avgScores := make(map[string]float64)
-		certaintyScores := make(map[string]float64)
-		inputScores := make(map[string]float64)
-
-		// initialize scores
-		for p, _ := range allHop {
-			// convert input to certainty
-			rigority := -math.Log(rigor)
-			fooB := -defaultUserConfidence * rigority
-			fooA := math.Exp(fooB)
-			//TheLog.Printf("fooA was %f", fooA)
-			certainty := 1 - fooA
-			//TheLog.Printf("certainty for %s was %f", p, certainty)
-			certaintyScores[p] = certainty
-			avgScores[p] = defaultUserScore
-			inputScores[p] = defaultUserConfidence
-			infScores[p] = certainty * defaultUserScore
-			//TheLog.Printf("initial score for %s was %f", p, infScores[p])
-		}
+	graph := LoadGraph(DB, pubkey, params.MaxHops, membership.MaxGraphSize)
+	me, _ := graph.ID(pubkey)
+	if graph.Truncated {
+		TheLog.Printf("graph for %s was truncated at the quota of %d pubkeys", pubkey, membership.MaxGraphSize)
+	}
+	run.Truncated = graph.Truncated
+	if params.Nip05Factor != 1 {
+		graph.loadNip05(DB)
+	}
+	run.InputHash = calculationInputHash(graph, params, algorithm)
+	progress(10)
 
-		// initialize my score
-		infScores[pubkey] = 1.0
-		avgScores[pubkey] = 1.0
-		inputScores[pubkey] = 9999
-		certaintyScores[pubkey] = 1.0
-		// make sure YOUR score never gets overwritten ^^^
-
-		// add mypubkey to allHops ? nah doesn't matter
-		allHop[pubkey] = person
-
-		// cycle scores
-		for i := 0; i < 8; i++ {
-			for pkRatee, _ := range allHop {
-				if pkRatee != pubkey {
-					sumOfWeights := 0.0
-					sumOfProducts := 0.0
-					// unused?
-					//sumOfWeightsDirectRatings := 0.0
-
-					var thisHopFollowers []string
-					DB.Table("metadata_follows").Select("metadata_pubkey_hex").Where("follow_pubkey_hex = ?", pkRatee).Scan(&thisHopFollowers)
-					//TheLog.Printf("Found %d follows for %s", len(thisHopFollowers), pkRatee)
-
-					for _, pkRater := range thisHopFollowers {
-						if pkRater != pkRatee {
-							rating := float64(followInterpretationScore)
-							weight := float64(attenuationFactor) * infScores[pkRater] * float64(followInterpretationConfidence)
-							if pkRater == pubkey {
-								// no attenuationFactor
-								weight = infScores[pkRater] * float64(followInterpretationConfidence)
-							}
-
-							product := weight * rating
-							sumOfWeights += float64(weight)
-							sumOfProducts += float64(product)
-						}
-					}
-
-					// mutes: todo
-
-					if sumOfWeights > 0 {
-						average := (sumOfProducts / sumOfWeights)
-						input := sumOfWeights
-
-						// convert input to certainty
-						rigority := -math.Log(rigor)
-						fooB := -input * rigority
-						fooA := math.Exp(fooB)
-						certainty := 1 - fooA
-						influence := average * certainty
-						infScores[pkRatee] = float64(influence)
-						avgScores[pkRatee] = average
-						certaintyScores[pkRatee] = certainty
-						inputScores[pkRatee] = input
-					}
+	TheLog.Printf("%d hop follows for %s was: %d", params.MaxHops, pubkey, len(graph.Hops))
 
-				}
-			}
-			TheLog.Printf("calculated influence cycle %d\n", i)
-		}
+	result := scorer.Score(graph, me, params, func(p int) { progress(10 + 70*p/100) })
+	run.Iterations = result.Iterations
+	run.Converged = result.Converged
+	run.Deltas = result.Deltas
+	if params.Nip05Factor != 1 {
+		applyNip05Factor(graph, me, params, result)
+	}
+	run.OutputHash = scoresHash(graph, result.Scores)
+	var previous CalculationRun
+	if DB.Where("input_hash = ? and output_hash <> ?", run.InputHash, run.OutputHash).First(&previous).Error == nil {
+		TheLog.Printf("calculation for %s gave different scores than run %s with the same input %s", pubkey, previous.ID, run.InputHash)
+	}
 
-		TheLog.Printf("Calculated %d total influence scores\n", len(infScores))
-
-		DB.Unscoped().Model(&person).Association("GvScores").Unscoped().Clear()
-		TheLog.Printf("saving influence scores..")
-		for p, s := range infScores {
-			if s > 0 {
-				DB.Model(&GvScore{}).Create(&GvScore{
-					MetadataPubkey: person.PubkeyHex,
-					PubkeyHex:      p,
-					Score:          s,
-				})
-				//TheLog.Printf("Influence score for %s: %f", p, s)
-			}
-		}
-		TheLog.Printf("done.\n")
-
-		// wot scores
-		wotScores := make(map[string]int)
-
-		TheLog.Printf("calculating scores .... please wait \n")
-		for pk, _ := range allHop {
-			//var thisHopFollows []Metadata
-			//DB.Model(&person).Association("Follows").Find(&thisHopFollows)
-
-			var thisHopFollowers []string
-			DB.Table("metadata_follows").Select("metadata_pubkey_hex").Where("follow_pubkey_hex = ?", pk).Scan(&thisHopFollowers)
-
-			intersection := make(map[string]bool)
-			// intersection
-			for _, follower := range thisHopFollowers {
-				for _, follow := range follows {
-					if follower == follow.PubkeyHex {
-						intersection[follower] = true
-					}
+	TheLog.Printf("Calculated %d total %s scores\n", len(result.Scores), algorithm)
+
+	// scores of the other algorithms stay for comparison
+	DB.Where("metadata_pubkey = ? and algorithm = ?", person.PubkeyHex, algorithm).Delete(&GvScore{})
+	TheLog.Printf("saving influence scores..")
+	for p, s := range result.Scores {
+		DB.Model(&GvScore{}).Create(&GvScore{
+			MetadataPubkey:  person.PubkeyHex,
+			PubkeyHex:       graph.PubkeyOf(p),
+			Algorithm:       algorithm,
+			Score:           s.Score,
+			Average:         s.Average,
+			Input:           s.Input,
+			Certainty:       s.Certainty,
+			ScoringParamsID: params.ID,
+		})
+	}
+	TheLog.Printf("done.\n")
+
+	progress(90)
+
+	// wot scores
+	TheLog.Printf("calculating scores .... please wait \n")
+	wotScores := followsScorer{}.Score(graph, me, params, func(int) {}).Scores
+
+	DB.Unscoped().Model(&person).Association("WotScores").Unscoped().Clear()
+
+	TheLog.Printf("saving scores .... please wait \n")
+	for p, s := range wotScores {
+		DB.Model(&WotScore{}).Create(&WotScore{
+			MetadataPubkey: person.PubkeyHex,
+			Score:          int(s.Input),
+			PubkeyHex:      graph.PubkeyOf(p),
+		})
+	}
+
+	// deletes all associations
+	// FOR REFERENCE HOW NOT TO UPDATE ASSOCIATIONS RESULTS IN:
+	// "too many prepared statements" even with batching
+	/*
+		counter := 0
+		lastCount := 0
+		if len(scores) > 500 {
+			for _ = range scores {
+				if counter > 0 && counter%500 == 0 {
+					begin := counter - 500
+					end := counter
+					batch := scores[begin:end]
+					DB.Model(&person).Association("WotScores").Append(&batch)
+					TheLog.Printf("batching batch: %d, %d", begin, end)
+					lastCount = counter
+					time.Sleep(time.Second * 1)
 				}
+				counter += 1
+			}
+			if lastCount != counter+1 {
+				begin := lastCount
+				end := len(scores) - 1
+				remainingBatch := scores[begin:end]
+				DB.Model(&person).Association("WotScores").Append(&remainingBatch)
+				TheLog.Printf("remaining batch: %d, %d", begin, end)
 			}
 
-			wotScores[pk] = len(intersection)
+		} else {
+			DB.Model(&person).Association("WotScores").Append(&scores)
 		}
+	*/
 
-		//DB.Model(&person).Association("WotScores").Clear()
+	run.ScoringParamsID = params.ID
+	run.GraphSize = graph.Len()
+	run.FinishedAt = time.Now()
+	run.DurationMs = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+	DB.Create(&run)
 
-		DB.Unscoped().Model(&person).Association("WotScores").Unscoped().Clear()
+	TheLog.Printf("finished processing pubkey %s with %s, follows: %d, followers: %d, iterations: %d, converged: %v", person.PubkeyHex, algorithm, followsCount, followersCount, run.Iterations, run.Converged)
+	return nil
+}
+
+// calculationInputHash is a sha256 of everything a full calculation depends on
+func calculationInputHash(graph *Graph, params ScoringParams, algorithm string) string {
+	// which stored set the params are doesn't change the scores
+	params.ID = uuid.Nil
+	params.MetadataPubkey = ""
+	params.CreatedAt = time.Time{}
+	params.Algorithm = algorithm
+	knobs, _ := json.Marshal(params)
+
+	h := sha256.New()
+	h.Write([]byte(graph.Hash()))
+	h.Write(knobs)
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-		TheLog.Printf("saving scores .... please wait \n")
-		for p, s := range wotScores {
-			DB.Model(&WotScore{}).Create(&WotScore{
-				MetadataPubkey: person.PubkeyHex,
-				Score:          s,
-				PubkeyHex:      p,
-			})
+// scoresHash is a sha256 of the exact scores in graph id order
+func scoresHash(graph *Graph, scores map[int]PubkeyScore) string {
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	h := sha256.New()
+	var buf [8]byte
+	for _, id := range ids {
+		h.Write([]byte(graph.PubkeyOf(id)))
+		s := scores[id]
+		for _, v := range []float64{s.Score, s.Average, s.Input, s.Certainty} {
+			binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+			h.Write(buf[:])
 		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-		// deletes all associations
-		// FOR REFERENCE HOW NOT TO UPDATE ASSOCIATIONS RESULTS IN:
-		// "too many prepared statements" even with batching
-		/*
-			counter := 0
-			lastCount := 0
-			if len(scores) > 500 {
-				for _ = range scores {
-					if counter > 0 && counter%500 == 0 {
-						begin := counter - 500
-						end := counter
-						batch := scores[begin:end]
-						DB.Model(&person).Association("WotScores").Append(&batch)
-						TheLog.Printf("batching batch: %d, %d", begin, end)
-						lastCount = counter
-						time.Sleep(time.Second * 1)
-					}
-					counter += 1
-				}
-				if lastCount != counter+1 {
-					begin := lastCount
-					end := len(scores) - 1
-					remainingBatch := scores[begin:end]
-					DB.Model(&person).Association("WotScores").Append(&remainingBatch)
-					TheLog.Printf("remaining batch: %d, %d", begin, end)
-				}
+// grapeRankState holds the GrapeRank outputs for every pubkey of a graph, indexed by graph id.
+// pubkeys that are not scored stay at zero.
+type grapeRankState struct {
+	graph     *Graph
+	me        int
+	params    ScoringParams
+	inf       []float64
+	avg       []float64
+	certainty []float64
+	input     []float64
+	scored    []bool
+}
+
+func newGrapeRankState(graph *Graph, me int, params ScoringParams) *grapeRankState {
+	s := &grapeRankState{
+		graph:     graph,
+		me:        me,
+		params:    params,
+		inf:       make([]float64, graph.Len()),
+		avg:       make([]float64, graph.Len()),
+		certainty: make([]float64, graph.Len()),
+		input:     make([]float64, graph.Len()),
+		scored:    make([]bool, graph.Len()),
+	}
+
+	// initialize scores
+	for _, p := range graph.Hops {
+		s.reset(p)
+		s.scored[p] = true
+	}
 
-			} else {
-				DB.Model(&person).Association("WotScores").Append(&scores)
+	// initialize my score
+	s.inf[me] = 1.0
+	s.avg[me] = 1.0
+	s.input[me] = 9999
+	s.certainty[me] = 1.0
+	s.scored[me] = true
+	// make sure YOUR score never gets overwritten ^^^
+	return s
+}
+
+// certaintyOf converts input to certainty
+func (s *grapeRankState) certaintyOf(input float64) float64 {
+	rigority := -math.Log(s.params.Rigor)
+	fooB := -input * rigority
+	fooA := math.Exp(fooB)
+	return 1 - fooA
+}
+
+// reset puts a pubkey back to the default score
+func (s *grapeRankState) reset(p int) {
+	certainty := s.certaintyOf(s.params.DefaultUserConfidence)
+	s.certainty[p] = certainty
+	s.avg[p] = s.params.DefaultUserScore
+	s.input[p] = s.params.DefaultUserConfidence
+	s.inf[p] = certainty * s.params.DefaultUserScore
+}
+
+// update recomputes a ratee from the follows and mutes of its raters and
+// returns how much its influence changed
+func (s *grapeRankState) update(pkRatee int) float64 {
+	if pkRatee == s.me {
+		return 0
+	}
+	attenuationFactor := s.params.AttenuationFactor
+	sumOfWeights := 0.0
+	sumOfProducts := 0.0
+
+	for _, pkRater := range s.graph.Followers(pkRatee) {
+		if pkRater != pkRatee {
+			rating := s.params.FollowInterpretationScore
+			weight := attenuationFactor * s.inf[pkRater] * s.params.FollowInterpretationConfidence
+			if pkRater == s.me {
+				// no attenuationFactor
+				weight = s.inf[pkRater] * s.params.FollowInterpretationConfidence
 			}
-		*/
 
-		TheLog.Printf("finished processing pubkey %s, follows: %d, followers: %d", person.PubkeyHex, followsCount, followersCount)
+			product := weight * rating
+			sumOfWeights += weight
+			sumOfProducts += product
+		}
+	}
+
+	// mutes count as a zero rating with more confidence than a follow
+	for _, pkRater := range s.graph.Muters(pkRatee) {
+		if pkRater != pkRatee {
+			rating := s.params.MuteInterpretationScore
+			weight := attenuationFactor * s.inf[pkRater] * s.params.MuteInterpretationConfidence
+			if pkRater == s.me {
+				// no attenuationFactor
+				weight = s.inf[pkRater] * s.params.MuteInterpretationConfidence
+			}
+
+			product := weight * rating
+			sumOfWeights += weight
+			sumOfProducts += product
+		}
+	}
+
+	previous := s.inf[pkRatee]
+	if sumOfWeights > 0 {
+		average := (sumOfProducts / sumOfWeights)
+		input := sumOfWeights
+		certainty := s.certaintyOf(input)
+		s.inf[pkRatee] = average * certainty
+		s.avg[pkRatee] = average
+		s.certainty[pkRatee] = certainty
+		s.input[pkRatee] = input
+	} else {
+		// nobody with influence rates this pubkey (anymore)
+		s.reset(pkRatee)
 	}
+	return math.Abs(s.inf[pkRatee] - previous)
 }
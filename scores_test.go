@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB points DB at a fresh in-memory sqlite database with the tables a calculation uses
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	TheLog = log.New(io.Discard, "", 0)
+	db, err := gorm.Open(GetDialector("", fmt.Sprintf("file:%s?mode=memory&cache=shared", t.Name())), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&Metadata{}, &WotScore{}, &GvScore{}, &ScoringParams{}, &CalculationRun{}, &Membership{}); err != nil {
+		t.Fatal(err)
+	}
+	DB = db
+	return db
+}
+
+func testPubkey(i int) string {
+	return fmt.Sprintf("%064x", i)
+}
+
+// testEdges is a member (1) with follows, follows of follows, mutes, a cycle
+// and pubkeys beyond the max hops
+var testEdges = []struct {
+	table  string
+	column string
+	rater  int
+	ratee  int
+}{
+	{"metadata_follows", "follow_pubkey_hex", 1, 2},
+	{"metadata_follows", "follow_pubkey_hex", 1, 3},
+	{"metadata_follows", "follow_pubkey_hex", 1, 4},
+	{"metadata_follows", "follow_pubkey_hex", 2, 3},
+	{"metadata_follows", "follow_pubkey_hex", 2, 5},
+	{"metadata_follows", "follow_pubkey_hex", 3, 2},
+	{"metadata_follows", "follow_pubkey_hex", 3, 6},
+	{"metadata_follows", "follow_pubkey_hex", 4, 5},
+	{"metadata_follows", "follow_pubkey_hex", 4, 7},
+	{"metadata_follows", "follow_pubkey_hex", 5, 1},
+	{"metadata_follows", "follow_pubkey_hex", 5, 8},
+	{"metadata_follows", "follow_pubkey_hex", 6, 9},
+	{"metadata_follows", "follow_pubkey_hex", 7, 6},
+	{"metadata_mutes", "mute_pubkey_hex", 2, 7},
+	{"metadata_mutes", "mute_pubkey_hex", 4, 6},
+	{"metadata_mutes", "mute_pubkey_hex", 6, 5},
+}
+
+type testCalculation struct {
+	runs   map[string]CalculationRun
+	scores map[string]GvScore
+}
+
+// calculateTestGraph stores the test graph with rows inserted in order and
+// runs a full calculation with every algorithm
+func calculateTestGraph(t *testing.T, order []int) testCalculation {
+	db := openTestDB(t)
+	for i := 9; i >= 1; i-- {
+		db.Create(&Metadata{PubkeyHex: testPubkey(i)})
+	}
+	if err := EnrollMember(db, DefaultMembership(testPubkey(1))); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range order {
+		e := testEdges[i]
+		db.Exec("insert into "+e.table+" (metadata_pubkey_hex, "+e.column+") values (?, ?)", testPubkey(e.rater), testPubkey(e.ratee))
+	}
+
+	result := testCalculation{runs: make(map[string]CalculationRun), scores: make(map[string]GvScore)}
+	for _, algorithm := range algorithmNames() {
+		if err := calculateWot(testPubkey(1), algorithm, nil); err != nil {
+			t.Fatal(err)
+		}
+		var run CalculationRun
+		db.Where("algorithm = ?", algorithm).Order("started_at desc").First(&run)
+		result.runs[algorithm] = run
+	}
+	var scores []GvScore
+	db.Find(&scores)
+	for _, s := range scores {
+		result.scores[s.Algorithm+" "+s.PubkeyHex] = s
+	}
+	return result
+}
+
+func TestCalculationIsReproducible(t *testing.T) {
+	forward := make([]int, len(testEdges))
+	backward := make([]int, len(testEdges))
+	shuffled := make([]int, len(testEdges))
+	for i := range testEdges {
+		forward[i] = i
+		backward[i] = len(testEdges) - 1 - i
+		// 7 and the number of edges are coprime, so this visits every edge once
+		shuffled[i] = (i * 7) % len(testEdges)
+	}
+
+	want := calculateTestGraph(t, forward)
+	if len(want.scores) == 0 {
+		t.Fatal("no scores calculated")
+	}
+	for name, order := range map[string][]int{"backward": backward, "shuffled": shuffled} {
+		t.Run(name, func(t *testing.T) {
+			got := calculateTestGraph(t, order)
+			for algorithm, run := range want.runs {
+				if run.InputHash == "" || run.OutputHash == "" {
+					t.Fatalf("%s: run without hashes", algorithm)
+				}
+				if got.runs[algorithm].InputHash != run.InputHash {
+					t.Errorf("%s: input hash %s, want %s", algorithm, got.runs[algorithm].InputHash, run.InputHash)
+				}
+				if got.runs[algorithm].OutputHash != run.OutputHash {
+					t.Errorf("%s: output hash %s, want %s", algorithm, got.runs[algorithm].OutputHash, run.OutputHash)
+				}
+			}
+			if len(got.scores) != len(want.scores) {
+				t.Fatalf("%d scores, want %d", len(got.scores), len(want.scores))
+			}
+			for key, w := range want.scores {
+				g, ok := got.scores[key]
+				if !ok {
+					t.Errorf("%s: missing score", key)
+					continue
+				}
+				if g.Score != w.Score || g.Average != w.Average || g.Input != w.Input || g.Certainty != w.Certainty {
+					t.Errorf("%s: got %+v, want %+v", key, g, w)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	// requests arriving within this window are merged into the same subscriptions
+	subscribeMergeWindow = 2 * time.Second
+	// most filters in one REQ, relays limit how many they accept
+	maxFiltersPerSub = 10
+	// most authors in one filter
+	maxAuthorsPerFilter = 1000
+	// most subscriptions open on one connection, relays CLOSE the ones over their limit
+	maxSubsPerRelay = 20
+	// since timestamps are rounded down to this so requests of different members merge
+	sinceGranularity = 60 * 60
+)
+
+// subRequest is what one member wants from a relay: events of kinds by
+// authors, each author since a timestamp (0 for everything the relay has)
+type subRequest struct {
+	member  string
+	kinds   []int
+	authors map[string]nostr.Timestamp
+	eose    chan struct{}
+}
+
+// coverage is the subscription already asking a relay for an author and kind, and since when
+type coverage struct {
+	sub   *poolSub
+	since nostr.Timestamp
+}
+
+// poolSub is a merged subscription the pool fires again after a reconnect
+type poolSub struct {
+	filters nostr.Filters
+	// sub is the subscription on the current connection, nil until fired
+	sub *nostr.Subscription
+	// lastEOSE is zero until the relay sent the stored events once
+	lastEOSE time.Time
+	waiters  []*subWaiter
+}
+
+// subWaiter is a request waiting for the EOSE of every subscription serving it
+type subWaiter struct {
+	member  string
+	eose    chan struct{}
+	pending int
+}
+
+// Request asks the relay for events of kinds by authors for member. Requests
+// are collected for a moment and merged with those of other members, authors
+// and kinds the relay's subscriptions already cover are left out. eose (may
+// be nil) gets a value once everything the request needs was sent.
+func (p *RelayPool) Request(url string, member string, kinds []int, authors map[string]nostr.Timestamp, eose chan struct{}) error {
+	r := p.get(url)
+	if r == nil {
+		return errNotConnected
+	}
+	r.mu.Lock()
+	r.members[member] = true
+	r.lastUsed = time.Now()
+	r.pending = append(r.pending, &subRequest{member: member, kinds: kinds, authors: authors, eose: eose})
+	start := !r.flushing
+	r.flushing = true
+	r.mu.Unlock()
+	if start {
+		time.AfterFunc(subscribeMergeWindow, r.flush)
+	}
+	return nil
+}
+
+// roundSince rounds down to sinceGranularity, asking for a bit more lets more requests share a filter
+func roundSince(since nostr.Timestamp) nostr.Timestamp {
+	return since - since%sinceGranularity
+}
+
+// subPlan is how a batch of requests is served: new subscriptions for what the
+// relay isn't asked for yet and the subscriptions every request waits for
+type subPlan struct {
+	subs []*poolSub
+	// waiters[i] is the waiter of the i-th request, waitsFor[i] the new and
+	// still loading subscriptions it waits for
+	waiters  []*subWaiter
+	waitsFor [][]*poolSub
+	// evict are the oldest open subscriptions that sent their stored events, closed to make room
+	evict              []*poolSub
+	requested, covered int
+}
+
+// planSubs merges requests into subscriptions, leaving out the authors and
+// kinds covered already asks for since the same time or earlier. It changes
+// neither covered nor open, flush applies the plan.
+func planSubs(covered map[int]map[string]coverage, open []*poolSub, requests []*subRequest) subPlan {
+	var plan subPlan
+
+	// what is still missing per author: the kinds and the earliest since
+	type need struct {
+		kinds map[int]bool
+		since nostr.Timestamp
+	}
+	needs := make(map[string]*need)
+	covering := make([]map[*poolSub]bool, len(requests))
+	for i, req := range requests {
+		covering[i] = make(map[*poolSub]bool)
+		for author, since := range req.authors {
+			since = roundSince(since)
+			for _, kind := range req.kinds {
+				plan.requested++
+				if c, ok := covered[kind][author]; ok && c.since <= since {
+					plan.covered++
+					if c.sub.lastEOSE.IsZero() {
+						covering[i][c.sub] = true
+					}
+					continue
+				}
+				n, ok := needs[author]
+				if !ok {
+					n = &need{kinds: make(map[int]bool), since: since}
+					needs[author] = n
+				}
+				n.kinds[kind] = true
+				if since < n.since {
+					n.since = since
+				}
+			}
+		}
+	}
+
+	// authors needing the same kinds since the same time share filters
+	type filterGroup struct {
+		kinds   []int
+		since   nostr.Timestamp
+		authors []string
+	}
+	groups := make(map[string]*filterGroup)
+	for author, n := range needs {
+		kinds := make([]int, 0, len(n.kinds))
+		for k := range n.kinds {
+			kinds = append(kinds, k)
+		}
+		sort.Ints(kinds)
+		key := fmt.Sprint(kinds, n.since)
+		g, ok := groups[key]
+		if !ok {
+			g = &filterGroup{kinds: kinds, since: n.since}
+			groups[key] = g
+		}
+		g.authors = append(g.authors, author)
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var filters nostr.Filters
+	for _, key := range keys {
+		g := groups[key]
+		sort.Strings(g.authors)
+		var since *nostr.Timestamp
+		if g.since > 0 {
+			s := g.since
+			since = &s
+		}
+		for begin := 0; begin < len(g.authors); begin += maxAuthorsPerFilter {
+			end := begin + maxAuthorsPerFilter
+			if end > len(g.authors) {
+				end = len(g.authors)
+			}
+			filters = append(filters, nostr.Filter{
+				Kinds:   g.kinds,
+				Authors: g.authors[begin:end],
+				Since:   since,
+				Limit:   (end - begin) * len(g.kinds),
+			})
+		}
+	}
+
+	authorSub := make(map[string]*poolSub)
+	for begin := 0; begin < len(filters); begin += maxFiltersPerSub {
+		end := begin + maxFiltersPerSub
+		if end > len(filters) {
+			end = len(filters)
+		}
+		ps := &poolSub{filters: filters[begin:end]}
+		plan.subs = append(plan.subs, ps)
+		for _, f := range ps.filters {
+			for _, author := range f.Authors {
+				authorSub[author] = ps
+			}
+		}
+	}
+
+	// every request waits for the subscriptions its authors ended up in
+	for i, req := range requests {
+		for author := range req.authors {
+			if ps, ok := authorSub[author]; ok {
+				covering[i][ps] = true
+			}
+		}
+		subs := make([]*poolSub, 0, len(covering[i]))
+		for ps := range covering[i] {
+			subs = append(subs, ps)
+		}
+		plan.waiters = append(plan.waiters, &subWaiter{member: req.member, eose: req.eose})
+		plan.waitsFor = append(plan.waitsFor, subs)
+	}
+
+	// make room by closing the oldest subscriptions that sent their stored events,
+	// their authors are asked for again by the next scrape that needs them
+	for _, ps := range open {
+		if len(open)-len(plan.evict)+len(plan.subs) <= maxSubsPerRelay {
+			break
+		}
+		if !ps.lastEOSE.IsZero() {
+			plan.evict = append(plan.evict, ps)
+		}
+	}
+	return plan
+}
+
+// flush merges the pending requests into new subscriptions and fires them
+func (r *poolRelay) flush() {
+	r.mu.Lock()
+	requests := r.pending
+	r.pending = nil
+	r.flushing = false
+	plan := planSubs(r.coverage, r.subs, requests)
+
+	var ready []*subWaiter
+	var unsubs []*nostr.Subscription
+	for _, ps := range plan.evict {
+		waiters, sub := r.removeSub(ps)
+		ready = append(ready, waiters...)
+		if sub != nil {
+			unsubs = append(unsubs, sub)
+		}
+	}
+	for _, ps := range plan.subs {
+		r.cover(ps)
+	}
+	for i, w := range plan.waiters {
+		for _, ps := range plan.waitsFor[i] {
+			ps.waiters = append(ps.waiters, w)
+			w.pending++
+		}
+		if w.pending == 0 {
+			ready = append(ready, w)
+		}
+	}
+	r.subs = append(r.subs, plan.subs...)
+	conn := r.conn
+	r.mu.Unlock()
+
+	TheLog.Printf("merged %d requests on %s into %d subscriptions, %d of %d author kinds were already covered", len(requests), r.url, len(plan.subs), plan.covered, plan.requested)
+	if len(plan.evict) > 0 {
+		TheLog.Printf("closing %d old subscriptions on %s to stay under %d", len(plan.evict), r.url, maxSubsPerRelay)
+	}
+	for _, sub := range unsubs {
+		sub.Unsub()
+	}
+	for _, w := range ready {
+		w.finish(r.url)
+	}
+	if conn == nil {
+		// the watcher fires them once it reconnected
+		return
+	}
+	for _, ps := range plan.subs {
+		if err := r.fire(conn, ps, ps.filters); err != nil {
+			TheLog.Printf("error subscribing on %s: %s", r.url, err)
+		}
+	}
+}
+
+// cover records what a new subscription asks the relay for, unless another
+// one already asks for it since earlier. r.mu must be held.
+func (r *poolRelay) cover(ps *poolSub) {
+	for _, f := range ps.filters {
+		var since nostr.Timestamp
+		if f.Since != nil {
+			since = *f.Since
+		}
+		for _, author := range f.Authors {
+			for _, kind := range f.Kinds {
+				if r.coverage[kind] == nil {
+					r.coverage[kind] = make(map[string]coverage)
+				}
+				if c, ok := r.coverage[kind][author]; !ok || since < c.since {
+					r.coverage[kind][author] = coverage{sub: ps, since: since}
+				}
+			}
+		}
+	}
+}
+
+func (r *poolRelay) fire(conn *nostr.Relay, ps *poolSub, filters nostr.Filters) error {
+	sub, err := conn.Subscribe(CTX, filters)
+	if err != nil {
+		r.mu.Lock()
+		r.errors++
+		r.mu.Unlock()
+		return err
+	}
+	r.mu.Lock()
+	ps.sub = sub
+	r.mu.Unlock()
+	go processSub(sub, conn, func() { r.gotEOSE(ps) }, func() { r.subClosed(ps, conn) })
+	return nil
+}
+
+// subClosed forgets a subscription the relay closed, or the pool closed to
+// make room, so its authors are asked for again. Subscriptions ending because
+// the connection dropped are kept, the watcher fires them again.
+func (r *poolRelay) subClosed(ps *poolSub, conn *nostr.Relay) {
+	if !conn.IsConnected() {
+		return
+	}
+	r.mu.Lock()
+	waiters, _ := r.removeSub(ps)
+	r.mu.Unlock()
+	// nothing more is coming for them, don't leave them to the EOSE timeouts
+	for _, w := range waiters {
+		w.finish(r.url)
+	}
+}
+
+// removeSub drops a subscription and the coverage it provides, returning the
+// waiters that were only waiting for it and its current subscription. r.mu
+// must be held.
+func (r *poolRelay) removeSub(ps *poolSub) ([]*subWaiter, *nostr.Subscription) {
+	found := false
+	for i, other := range r.subs {
+		if other == ps {
+			r.subs = append(r.subs[:i], r.subs[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	for _, f := range ps.filters {
+		for _, author := range f.Authors {
+			for _, kind := range f.Kinds {
+				if c, ok := r.coverage[kind][author]; ok && c.sub == ps {
+					delete(r.coverage[kind], author)
+				}
+			}
+		}
+	}
+	var done []*subWaiter
+	for _, w := range ps.waiters {
+		w.pending--
+		if w.pending == 0 {
+			done = append(done, w)
+		}
+	}
+	ps.waiters = nil
+	return done, ps.sub
+}
+
+func (r *poolRelay) gotEOSE(ps *poolSub) {
+	r.mu.Lock()
+	ps.lastEOSE = time.Now()
+	var done []*subWaiter
+	for _, w := range ps.waiters {
+		w.pending--
+		if w.pending == 0 {
+			done = append(done, w)
+		}
+	}
+	ps.waiters = nil
+	r.mu.Unlock()
+	for _, w := range done {
+		w.finish(r.url)
+	}
+}
+
+// waitForAll makes every member of the relay wait for subs, after a reconnect
+func (r *poolRelay) waitForAll(subs []*poolSub) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for member := range r.members {
+		w := &subWaiter{member: member}
+		for _, ps := range subs {
+			ps.waiters = append(ps.waiters, w)
+			w.pending++
+		}
+	}
+}
+
+func (w *subWaiter) finish(url string) {
+	UpdateOrCreateRelayStatus(DB, url, "connection established: EOSE", w.member)
+	if w.eose != nil {
+		select {
+		case w.eose <- struct{}{}:
+		default:
+		}
+	}
+}
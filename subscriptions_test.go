@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func testAuthors(n int, since nostr.Timestamp) map[string]nostr.Timestamp {
+	authors := make(map[string]nostr.Timestamp)
+	for i := 0; i < n; i++ {
+		authors[testPubkey(i)] = since
+	}
+	return authors
+}
+
+func TestPlanSubs(t *testing.T) {
+	loaded := &poolSub{lastEOSE: time.Now()}
+	loading := &poolSub{}
+	a, b := testPubkey(1), testPubkey(2)
+
+	t.Run("covered authors are left out", func(t *testing.T) {
+		covered := map[int]map[string]coverage{3: {a: {sub: loaded}}}
+		plan := planSubs(covered, nil, []*subRequest{
+			{kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 0, b: 0}},
+		})
+		if plan.requested != 2 || plan.covered != 1 {
+			t.Errorf("%d of %d covered, want 1 of 2", plan.covered, plan.requested)
+		}
+		if len(plan.subs) != 1 || len(plan.subs[0].filters) != 1 {
+			t.Fatalf("%d subscriptions, want 1 with 1 filter", len(plan.subs))
+		}
+		if authors := plan.subs[0].filters[0].Authors; len(authors) != 1 || authors[0] != b {
+			t.Errorf("asked for %v, want only %s", authors, b)
+		}
+		// the loaded subscription sent its events already
+		if len(plan.waitsFor[0]) != 1 || plan.waitsFor[0][0] != plan.subs[0] {
+			t.Errorf("waits for %v, want only the new subscription", plan.waitsFor[0])
+		}
+	})
+
+	t.Run("covered by a loading subscription", func(t *testing.T) {
+		covered := map[int]map[string]coverage{3: {a: {sub: loading}}, 10000: {a: {sub: loaded}}}
+		plan := planSubs(covered, nil, []*subRequest{
+			{kinds: []int{3, 10000}, authors: map[string]nostr.Timestamp{a: 0}},
+		})
+		if len(plan.subs) != 0 {
+			t.Errorf("%d subscriptions, want none", len(plan.subs))
+		}
+		if len(plan.waitsFor[0]) != 1 || plan.waitsFor[0][0] != loading {
+			t.Errorf("waits for %v, want the loading subscription", plan.waitsFor[0])
+		}
+	})
+
+	t.Run("since", func(t *testing.T) {
+		covered := map[int]map[string]coverage{3: {a: {sub: loaded, since: 2 * sinceGranularity}}}
+		later := planSubs(covered, nil, []*subRequest{
+			{kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 2*sinceGranularity + 100}},
+		})
+		if len(later.subs) != 0 || later.covered != 1 {
+			t.Errorf("a later since was asked for again")
+		}
+		earlier := planSubs(covered, nil, []*subRequest{
+			{kinds: []int{3}, authors: map[string]nostr.Timestamp{a: sinceGranularity + 100}},
+		})
+		if len(earlier.subs) != 1 {
+			t.Fatalf("an earlier since was not asked for")
+		}
+		if since := earlier.subs[0].filters[0].Since; since == nil || *since != sinceGranularity {
+			t.Errorf("since %v, want it rounded down to %d", since, sinceGranularity)
+		}
+	})
+
+	t.Run("requests merge", func(t *testing.T) {
+		plan := planSubs(map[int]map[string]coverage{}, nil, []*subRequest{
+			{member: "m1", kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 0, b: 0}},
+			{member: "m2", kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 0}},
+		})
+		if len(plan.subs) != 1 || len(plan.subs[0].filters) != 1 || len(plan.subs[0].filters[0].Authors) != 2 {
+			t.Fatalf("requests for the same kinds were not merged into one filter")
+		}
+		for i, subs := range plan.waitsFor {
+			if len(subs) != 1 || subs[0] != plan.subs[0] {
+				t.Errorf("request %d waits for %v, want the merged subscription", i, subs)
+			}
+		}
+	})
+
+	t.Run("filters split", func(t *testing.T) {
+		n := maxFiltersPerSub*maxAuthorsPerFilter + maxAuthorsPerFilter/2
+		plan := planSubs(map[int]map[string]coverage{}, nil, []*subRequest{
+			{kinds: []int{0, 3}, authors: testAuthors(n, 0)},
+		})
+		if len(plan.subs) != 2 || len(plan.subs[0].filters) != maxFiltersPerSub || len(plan.subs[1].filters) != 1 {
+			t.Fatalf("%d subscriptions, want %d filters and 1", len(plan.subs), maxFiltersPerSub)
+		}
+		seen := make(map[string]bool)
+		for _, ps := range plan.subs {
+			for _, f := range ps.filters {
+				if len(f.Authors) > maxAuthorsPerFilter {
+					t.Errorf("filter with %d authors", len(f.Authors))
+				}
+				if f.Limit != len(f.Authors)*2 {
+					t.Errorf("limit %d for %d authors of 2 kinds", f.Limit, len(f.Authors))
+				}
+				for _, author := range f.Authors {
+					if seen[author] {
+						t.Errorf("%s asked for twice", author)
+					}
+					seen[author] = true
+				}
+			}
+		}
+		if len(seen) != n {
+			t.Errorf("asked for %d authors, want %d", len(seen), n)
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		open := make([]*poolSub, maxSubsPerRelay)
+		for i := range open {
+			open[i] = &poolSub{}
+			if i%2 == 0 {
+				open[i].lastEOSE = time.Now()
+			}
+		}
+		// 3 new subscriptions
+		request := []*subRequest{{kinds: []int{3}, authors: testAuthors(2*maxFiltersPerSub*maxAuthorsPerFilter+1, 0)}}
+		plan := planSubs(map[int]map[string]coverage{}, open, request)
+		if len(plan.subs) != 3 {
+			t.Fatalf("%d subscriptions, want 3", len(plan.subs))
+		}
+		if len(plan.evict) != 3 || plan.evict[0] != open[0] || plan.evict[1] != open[2] || plan.evict[2] != open[4] {
+			t.Errorf("evicted %v, want the 3 oldest that sent EOSE", plan.evict)
+		}
+
+		for _, ps := range open {
+			ps.lastEOSE = time.Time{}
+		}
+		if plan := planSubs(map[int]map[string]coverage{}, open, request); len(plan.evict) != 0 {
+			t.Errorf("evicted %d subscriptions still loading", len(plan.evict))
+		}
+	})
+}
+
+func TestFlushReleasesWaiters(t *testing.T) {
+	db := openTestDB(t)
+	if err := db.AutoMigrate(&RelayStatus{}); err != nil {
+		t.Fatal(err)
+	}
+	r := &poolRelay{url: "wss://relay.example.com", members: make(map[string]bool), coverage: make(map[int]map[string]coverage)}
+	a, b, c := testPubkey(1), testPubkey(2), testPubkey(3)
+
+	eose1 := make(chan struct{}, 1)
+	r.pending = []*subRequest{{member: "m1", kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 0, b: 0}, eose: eose1}}
+	r.flush()
+	if len(r.subs) != 1 {
+		t.Fatalf("%d subscriptions, want 1", len(r.subs))
+	}
+	first := r.subs[0]
+
+	// a is still loading on the first subscription, c needs a new one
+	eose2 := make(chan struct{}, 1)
+	r.pending = []*subRequest{{member: "m2", kinds: []int{3}, authors: map[string]nostr.Timestamp{a: 0, c: 0}, eose: eose2}}
+	r.flush()
+	if len(r.subs) != 2 {
+		t.Fatalf("%d subscriptions, want 2", len(r.subs))
+	}
+	second := r.subs[1]
+	if len(second.filters) != 1 || fmt.Sprint(second.filters[0].Authors) != fmt.Sprint([]string{c}) {
+		t.Fatalf("second subscription asks for %v, want only c", second.filters)
+	}
+	waiters := append(append([]*subWaiter{}, first.waiters...), second.waiters...)
+
+	r.gotEOSE(second)
+	select {
+	case <-eose2:
+		t.Fatal("m2 got EOSE before a was loaded")
+	default:
+	}
+
+	// the relay closes the first subscription
+	r.mu.Lock()
+	done, _ := r.removeSub(first)
+	r.mu.Unlock()
+	for _, w := range done {
+		w.finish(r.url)
+	}
+	for _, w := range waiters {
+		if w.pending != 0 {
+			t.Errorf("%s still waits for %d subscriptions", w.member, w.pending)
+		}
+	}
+	for member, eose := range map[string]chan struct{}{"m1": eose1, "m2": eose2} {
+		select {
+		case <-eose:
+		default:
+			t.Errorf("%s got no EOSE", member)
+		}
+	}
+	if _, ok := r.coverage[3][a]; ok {
+		t.Error("a is still covered by the closed subscription")
+	}
+	if cov, ok := r.coverage[3][c]; !ok || cov.sub != second {
+		t.Error("c is not covered by the second subscription")
+	}
+}